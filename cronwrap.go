@@ -1,45 +1,217 @@
 package main
 
 import (
+	"bytes"
+	crand "crypto/rand"
 	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
 	"os"
 	"os/exec"
+	"os/user"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
 	"unicode/utf8"
 )
 
+var statedir string
+var system bool
+var name string
 var jitter time.Duration
 var overlap bool
 var nice int
 var timeout time.Duration
+var timeoutperattempt bool
+var retries int
+var retrydelay time.Duration
+var retrybackoff string
+var retryjitter time.Duration
+var cleanenv bool
+var keepenv = stringList{}
+var envfiles = stringList{}
+var envvars = stringList{}
+var jobpath string
+var prehook string
+var posthook string
+var failurehook string
+var recoveryhook string
+var hooktimeout time.Duration
 var suppress int
+var suppressfor time.Duration
+var maxage time.Duration
+var historysize int64
+var metricsdir string
+var pushurl string
+var pushjob string
+var pushinstance string
+var pushtimeout time.Duration
+var pingstart string
+var pingsuccess string
+var pingfailure string
+var pingtimeout time.Duration
+var webhookurl string
+var webhooktemplatefile string
+var webhooktemplate *template.Template
+var webhookheaders = stringList{}
+var webhooktimeout time.Duration
+var mailto = stringList{}
+var mailfrom string
+var mailsubject string
+var mailsubjecttemplate *template.Template
+var smtpaddr string
+var smtpuser string
+var smtpstarttls bool
+var sendmail string
+var otlpendpoint string
+var otlptimeout time.Duration
+var logto string
+var logsocket string
+var statsdaddr string
+var statsdprefix string
+var statsdtags string
+var statsdformat string
+var flapwindow int
+var flapthreshold float64
+var successcodes = codeList{}
+var failurecodes = codeList{}
+var skipcodes = codeList{}
 var debug bool
 var version bool
+var helpall bool
+
+// Variables to set in the job's environment, from --env-file and --env
+var jobvars []string
+
+const systemdir = "/var/lib/cronwrap"
+
+var validenvname = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var validname = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+
+// Options shown by --help.  Everything else is shown by --help-all.
+var basicflags = []string{
+	"name",
+	"jitter",
+	"overlap",
+	"nice",
+	"timeout",
+	"suppress",
+	"suppress-for",
+	"retries",
+	"debug",
+	"version",
+	"help-all",
+}
 
 func main() {
 	const ver = "0.0.1"
 
+	// Subcommands for inspecting cronwrap's state.  A job with the same name as a
+	// subcommand can be run as "cronwrap -- <job>".
+	subcommand, args := findSubcommand(os.Args[1:])
+	switch subcommand {
+	case "check-stale":
+		os.Exit(checkStale(args))
+	case "status":
+		os.Exit(status(args))
+	case "gc":
+		os.Exit(gc(args))
+	}
+
 	//
 	// Parse Flags
 	//
 
+	flag.StringVar(&name, "name", "", "Identify job by name rather than by command line")
 	flag.DurationVar(&jitter, "jitter", 0, "Random delay before executing job")
 	flag.BoolVar(&overlap, "overlap", false, "Prevent multiple simultaneous copies of job")
 	flag.IntVar(&nice, "nice", 0, "Set process priority, a la the utility nice")
 	flag.DurationVar(&timeout, "timeout", 0, "Terminate job if it runs longer than given time")
+	flag.BoolVar(&timeoutperattempt, "timeout-per-attempt", false, "Apply timeout to each retry rather than overall")
+	flag.IntVar(&retries, "retries", 0, "Retry a failed job up to N times")
+	flag.DurationVar(&retrydelay, "retry-delay", 10*time.Second, "Delay before retrying a failed job")
+	flag.StringVar(&retrybackoff, "retry-backoff", "fixed", "Retry delay backoff, fixed or exponential")
+	flag.DurationVar(&retryjitter, "retry-jitter", 0, "Random additional delay before each retry")
 	flag.IntVar(&suppress, "suppress", 0, "Suppress errors unless job has N consecutive failures")
+	flag.DurationVar(&suppressfor, "suppress-for", 0, "Suppress errors unless job has failed for given time")
+	flag.IntVar(&flapwindow, "flap-window", 0, "Report failures if too many of the last N runs failed")
+	flag.Float64Var(&flapthreshold, "flap-threshold", 0.5, "Fraction of runs in flap-window that can fail")
+	flag.Int64Var(&historysize, "history-size", 1024*1024, "Rotate job history at N bytes, 0 disables history")
+	flag.StringVar(&metricsdir, "metrics-dir", "", "Write Prometheus metrics for node_exporter to directory")
+	flag.StringVar(&pushurl, "push-url", "", "Push Prometheus metrics to Pushgateway at URL")
+	flag.StringVar(&pushjob, "push-job", "", "Pushgateway job grouping label, defaults to job name")
+	flag.StringVar(&pushinstance, "push-instance", "", "Pushgateway instance grouping label, defaults to hostname")
+	flag.DurationVar(&pushtimeout, "push-timeout", 10*time.Second, "Timeout for pushing metrics")
+	flag.StringVar(&statsdaddr, "statsd", "", "Send metrics to StatsD agent at host:port")
+	flag.StringVar(&statsdprefix, "statsd-prefix", "cronwrap.", "Prefix for StatsD metric names")
+	flag.StringVar(&statsdtags, "statsd-tags", "", "Comma separated tags for DogStatsD metrics, i.e. env:prod")
+	flag.StringVar(&statsdformat, "statsd-format", "statsd", "StatsD format, statsd or dogstatsd")
+	flag.StringVar(&pingstart, "ping-start", "", "Ping URL when job starts")
+	flag.StringVar(&pingsuccess, "ping-success", "", "Ping URL/0 with tail of output when job succeeds")
+	flag.StringVar(&pingfailure, "ping-failure", "", "Ping URL/<exit value> with tail of output when job fails")
+	flag.DurationVar(&pingtimeout, "ping-timeout", 10*time.Second, "Timeout for each attempt to ping")
+	flag.StringVar(&webhookurl, "webhook", "", "POST JSON report to URL when a failure is reported")
+	flag.StringVar(&webhooktemplatefile, "webhook-template", "", "Go template file for webhook payload")
+	flag.Var(&webhookheaders, "webhook-header", "Header for webhook requests, i.e. 'Name: value', may be repeated")
+	flag.DurationVar(&webhooktimeout, "webhook-timeout", 10*time.Second, "Timeout for webhook requests")
+	flag.Var(&mailto, "mail-to", "Mail job output to address instead of leaving it to cron, may be repeated")
+	flag.StringVar(&mailfrom, "mail-from", "", "Sender address for mail, defaults to user@hostname")
+	flag.StringVar(&mailsubject, "mail-subject", "{{.Job}} {{.Result}} on {{.Host}}", "Go template for mail subject")
+	flag.StringVar(&smtpaddr, "smtp", "", "Send mail via SMTP server at host:port rather than sendmail")
+	flag.StringVar(&smtpuser, "smtp-user", "", "SMTP username, password is taken from CRONWRAP_SMTP_PASSWORD")
+	flag.BoolVar(&smtpstarttls, "smtp-starttls", false, "Require STARTTLS when sending mail via SMTP")
+	flag.StringVar(&sendmail, "sendmail", "/usr/sbin/sendmail", "Path to sendmail compatible program")
+	flag.StringVar(&otlpendpoint, "otlp-endpoint", "", "Send a trace of each run to OTLP/HTTP collector URL")
+	flag.DurationVar(&otlptimeout, "otlp-timeout", 10*time.Second, "Timeout for sending traces")
+	flag.StringVar(&logto, "log", "", "Log run lifecycle events to syslog or journald")
+	flag.StringVar(&logsocket, "log-socket", "", "Socket for --log, defaults to /dev/log or journald's")
+	flag.BoolVar(&cleanenv, "clean-env", false, "Start the job with an empty environment and a sane PATH")
+	flag.Var(&keepenv, "keep-env", "Keep variable from our environment, implies --clean-env, may be repeated")
+	flag.Var(&envfiles, "env-file", "Load variables for the job from dotenv style file, may be repeated")
+	flag.Var(&envvars, "env", "Set variable for the job, i.e. KEY=VALUE, may be repeated")
+	flag.StringVar(&jobpath, "path", "", "PATH for the job")
+	flag.StringVar(&prehook, "pre", "", "Shell command to run before the job, the job fails if it does")
+	flag.StringVar(&posthook, "post", "", "Shell command to run after the job, given the outcome in env vars")
+	flag.StringVar(&failurehook, "on-failure", "", "Shell command to run when a streak of failures is first reported")
+	flag.StringVar(&recoveryhook, "on-recovery", "", "Shell command to run when the job succeeds after that")
+	flag.DurationVar(&hooktimeout, "hook-timeout", 5*time.Minute, "Timeout for hook commands, 0 for none")
+	flag.DurationVar(&maxage, "max-age", 0, "Report job via check-stale if no success in given time")
+	flag.Var(&successcodes, "success-codes", "Exit codes that count as success, i.e. 0,24 or 0-2")
+	flag.Var(&failurecodes, "failure-codes", "Exit codes that count as failure, others are success")
+	flag.Var(&skipcodes, "skip-codes", "Exit codes that leave the failure count unchanged")
 	flag.BoolVar(&debug, "debug", false, "Print lots of messages about what cronwrap is doing")
 	flag.BoolVar(&version, "version", false, "Print cronwrap version and exit")
+	flag.BoolVar(&helpall, "help-all", false, "Print all options and exit")
+	addStateFlags(flag.CommandLine)
+	flag.Usage = usage
 	flag.Parse()
 
+	if helpall {
+		flag.CommandLine.SetOutput(os.Stdout)
+		fmt.Printf("Usage: %s [options] [--] <command> [args...]\n\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(0)
+	}
+
 	// flag.Args() has all of the remaining command line arguments, which will be
 	// the job command and its arguments
 	if len(flag.Args()) == 0 {
@@ -48,12 +220,150 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Options other than the state directory given before a subcommand would
+	// otherwise silently turn it into a job of the same name
+	if subcommands[flag.Arg(0)] && os.Args[len(os.Args)-flag.NArg()-1] != "--" {
+		fmt.Fprintf(os.Stderr, "Error: only -state-dir and -system can be given before %s, use -- to run a job named %s\n\n", flag.Arg(0), flag.Arg(0))
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// The name is used as a directory name, so keep it to something that is safe
+	// and sane in a filesystem
+	if name != "" && !validname.MatchString(name) {
+		fmt.Fprintf(os.Stderr, "Error: name should only contain letters, numbers, '.', '_' and '-'\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	if suppress < 0 {
 		fmt.Fprintf(os.Stderr, "Error: suppress should be a positive integer\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if flapwindow < 0 {
+		fmt.Fprintf(os.Stderr, "Error: flap-window should be a positive integer\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if flapthreshold < 0 || flapthreshold >= 1 {
+		fmt.Fprintf(os.Stderr, "Error: flap-threshold should be at least 0 and less than 1\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if retries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: retries should be a positive integer\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if retrydelay < 0 || retryjitter < 0 {
+		fmt.Fprintf(os.Stderr, "Error: retry delays should be positive times\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if retrybackoff != "fixed" && retrybackoff != "exponential" {
+		fmt.Fprintf(os.Stderr, "Error: retry-backoff should be fixed or exponential\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if historysize < 0 {
+		fmt.Fprintf(os.Stderr, "Error: history-size should be a positive integer\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if statsdformat != "statsd" && statsdformat != "dogstatsd" {
+		fmt.Fprintf(os.Stderr, "Error: statsd-format should be statsd or dogstatsd\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if logto != "" && logto != "syslog" && logto != "journald" {
+		fmt.Fprintf(os.Stderr, "Error: log should be syslog or journald\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if webhooktemplatefile != "" {
+		var err error
+		webhooktemplate, err = template.New(path.Base(webhooktemplatefile)).Funcs(templatefuncs).ParseFiles(webhooktemplatefile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid webhook-template: %s\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	for _, header := range webhookheaders {
+		if !strings.Contains(header, ":") {
+			fmt.Fprintf(os.Stderr, "Error: webhook-header should be of the form 'Name: value'\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	for _, name := range keepenv {
+		if !validenvname.MatchString(name) {
+			fmt.Fprintf(os.Stderr, "Error: invalid keep-env variable name %q\n\n", name)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	// Variables from files come first so that --env can override them
+	for _, envfile := range envfiles {
+		vars, err := readEnvFile(envfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid env-file: %s\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		jobvars = append(jobvars, vars...)
+	}
+	for _, envvar := range envvars {
+		i := strings.Index(envvar, "=")
+		if i == -1 || !validenvname.MatchString(envvar[:i]) {
+			fmt.Fprintf(os.Stderr, "Error: env should be of the form KEY=VALUE\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		jobvars = append(jobvars, envvar)
+	}
+
+	if len(mailto) != 0 {
+		var err error
+		mailsubjecttemplate, err = template.New("mail-subject").Funcs(templatefuncs).Parse(mailsubject)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid mail-subject: %s\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if hooktimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Error: hook-timeout should be a positive time\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if maxage < 0 {
+		fmt.Fprintf(os.Stderr, "Error: max-age should be a positive time\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if suppressfor < 0 {
+		fmt.Fprintf(os.Stderr, "Error: suppress-for should be a positive time\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	if version {
 		fmt.Printf("cronwrap version %s\n", ver)
 		os.Exit(0)
@@ -63,45 +373,77 @@ func main() {
 	// Prep work
 	//
 
-	// This value for workdir is open to debate.  Using a system directory like
-	// /var/lib/cronwrap would restrict cronwrap to use by root, which doesn't seem
-	// desirable.  Using $TMPDIR or other world writable, sticky bit enabled
-	// directories makes it hard for us to come up with a way to identify what
-	// directory cronwrap should use, given that we can't guarantee any specific
-	// filename will be available. I.e. we can't assume /tmp/cronwrap will be
-	// available for us to use.  If one instance uses mktemp and creates
-	// /tmp/cronwrap.45e2f7 how is any other instance to know that's valid?  And we
-	// don't want to lose state to cleanup from tmpwatch or system reboots.  Using
-	// $HOME for variable/temporary state data isn't ideal, but it's the best I'm
-	// coming up with at the moment.
-	workdir := path.Join(os.Getenv("HOME"), ".cronwrap")
-	err := os.MkdirAll(workdir, 0755)
-	check(err)
+	workdir := prepareWorkDir()
 
+	// Jobs are identified by the SHA1 of their command line unless the user gave
+	// them a name
 	cmdAsString := fmt.Sprintf("%q", flag.Args())
-	cmdsha1bytes := sha1.Sum([]byte(cmdAsString))
-	cmdsha1 := fmt.Sprintf("%x", cmdsha1bytes)
-	if debug {
-		fmt.Printf("Command SHA1: %s\n", cmdsha1)
+	jobid := name
+	if jobid == "" {
+		cmdsha1bytes := sha1.Sum([]byte(cmdAsString))
+		jobid = fmt.Sprintf("%x", cmdsha1bytes)
+		if debug {
+			fmt.Printf("Command SHA1: %s\n", jobid)
+		}
 	}
 
-	jobdir := path.Join(workdir, cmdsha1)
-	err = os.MkdirAll(jobdir, 0755)
-	check(err)
+	// The name used to identify the job to users and in metrics
+	jobname := name
+	if jobname == "" {
+		jobname = cmdAsString
+	}
 
-	// Write out a file with the command line to make it easier for users to figure
-	// out which job is associated with a directory in our working space.  A
-	// directory full of SHA1 sums isn't very user friendly.
-	cmdfile := path.Join(jobdir, "command")
-	_, err = os.Stat(cmdfile)
-	if err != nil {
-		file, err := os.Create(cmdfile)
-		check(err)
-		_, err = file.WriteString(cmdAsString)
-		check(err)
-		err = file.Close()
-		check(err)
+	jobdir := path.Join(workdir, jobid)
+	runlock := lockRun(jobdir)
+
+	// Every run has a unique id.  The job and hooks are told it along with the
+	// job's identity and where our state is kept, so that a nested cronwrap uses
+	// the same state directory.
+	runid := randomID(16)
+	runenv := []string{
+		"CRONWRAP_JOB=" + jobname,
+		"CRONWRAP_JOB_ID=" + jobid,
+		"CRONWRAP_RUN_ID=" + runid,
+		"CRONWRAP_STATE_DIR=" + workdir,
+	}
+
+	logfields["job"] = jobname
+	logfields["job_id"] = jobid
+	logfields["run_id"] = runid
+	logEvent(loginfo, "start", "Starting job "+jobname, map[string]string{"command": cmdAsString})
+
+	// Each run is a trace, or part of the trace of whatever started us if it
+	// passed on its context.  The root span covers the whole run.
+	tracestart := time.Now()
+	if otlpendpoint != "" {
+		startTrace(os.Getenv("TRACEPARENT"))
+	}
+
+	// Record the command line in the job's state to make it easier for users to
+	// figure out which job is associated with a directory in our working space.
+	// A directory full of SHA1 sums isn't very user friendly.  The command line of
+	// a named job can change, so keep it up to date.  Also record the maximum age
+	// declared for this job for check-stale.
+	//
+	// Problems with the state are reported but mustn't stop the job running.
+	// Unreadable state is replaced with fresh state, except that state from a
+	// newer version of cronwrap is left alone.
+	statelock := lockState(jobdir)
+	state, stateerr := readState(jobdir)
+	if stateerr != nil {
+		fmt.Fprintf(os.Stderr, "cronwrap: %s, running job with fresh state\n", stateerr)
+	}
+	state.Command = cmdAsString
+	state.MaxAge = ""
+	if maxage != 0 {
+		state.MaxAge = maxage.String()
+	}
+	err := writeState(jobdir, state)
+	if err != nil && stateerr == nil {
+		fmt.Fprintf(os.Stderr, "cronwrap: unable to save state: %s\n", err)
 	}
+	err = statelock.Close()
+	check(err)
 
 	//
 	// Jitter
@@ -123,7 +465,11 @@ func main() {
 		if debug {
 			fmt.Printf("Jitter delay of %d seconds\n", int64(delay.Seconds()))
 		}
+		logEvent(loginfo, "jitter", fmt.Sprintf("Delaying job %s by %s for jitter", jobname, delay),
+			map[string]string{"delay": fmt.Sprintf("%g", delay.Seconds())})
+		jitterstart := time.Now()
 		time.Sleep(delay)
+		addSpan("jitter", newSpanID(), jitterstart, time.Now(), attribute("cronwrap.jitter.delay", delay.Seconds()))
 	}
 
 	//
@@ -141,14 +487,53 @@ func main() {
 		if debug {
 			fmt.Printf("Attempting to lock PID file: %s\n", pidfilename)
 		}
+		lockstart := time.Now()
 		err = syscall.Flock(int(pidfile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		addSpan("lock", newSpanID(), lockstart, time.Now(), attribute("cronwrap.lock.acquired", err == nil))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Job is already running\n")
+			logEvent(logwarning, "lock_skipped", "Job "+jobname+" is already running, skipping this run", nil)
+			now := time.Now()
+			statelock := lockState(jobdir)
+			state, err := readState(jobdir)
+			if err == nil {
+				state.LastRun = &now
+				state.LastResult = "overlap"
+				_ = writeState(jobdir, state)
+			}
+			writeHistory(jobdir, historyRecord{
+				Start:          now,
+				End:            now,
+				Result:         "overlap",
+				ExitStatus:     1,
+				OverlapSkipped: true,
+				RunID:          runid,
+				Version:        ver,
+			})
+			_ = statelock.Close()
+			if statsdaddr != "" {
+				sendStatsd(jobname, []string{"overlap_skips:1|c"})
+			}
+			if otlpendpoint != "" {
+				err = sendTrace(jobname, tracestart, true, attribute("process.command_line", cmdAsString),
+					attribute("cronwrap.overlap_skipped", true))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "cronwrap: unable to send trace: %s\n", err)
+				}
+			}
+			_ = runlock.Close()
 			os.Exit(1)
 		}
 		if debug {
 			fmt.Printf("Locked PID file: %s\n", pidfilename)
 		}
+		logEvent(loginfo, "lock_acquired", "Acquired overlap lock for job "+jobname, nil)
+		// A PID file left behind by a run that was killed may hold a longer PID
+		// than ours, which mustn't be left on the end of it
+		err = pidfile.Truncate(0)
+		check(err)
+		_, err = pidfile.Seek(0, 0)
+		check(err)
 		_, err = pidfile.WriteString(fmt.Sprintf("%d", os.Getpid()))
 		check(err)
 	}
@@ -175,82 +560,120 @@ func main() {
 	// Spawn the job
 	//
 
-	// Run the job in a goroutine
-	type CombinedOutput struct {
-		output    []byte
-		exitvalue int
-	}
-	cmdch := make(chan *exec.Cmd, 1)
-	resch := make(chan CombinedOutput, 1)
-	go func() {
-		if debug {
-			fmt.Printf("Spawning job\n")
-		}
-		cmd := exec.Command(flag.Args()[0], flag.Args()[1:]...)
-		// Stash the command in a channel in case we need in later to handle
-		// a timeout
-		cmdch <- cmd
-		output, err := cmd.CombinedOutput()
-		exitvalue := 0
+	if pingstart != "" {
+		err = ping(pingstart, nil)
 		if err != nil {
-			// This involves some Go magic I don't yet understand
-			// http://stackoverflow.com/questions/10385551/get-exit-code-go
-			if exiterr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					exitvalue = status.ExitStatus()
-				}
-			}
-		}
-		if debug {
-			fmt.Printf("Job exited with status %d\n", exitvalue)
-			fmt.Printf("Captured %d characters of output from job\n", utf8.RuneCountInString(string(output)))
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to send start ping: %s\n", err)
 		}
-		resch <- CombinedOutput{output, exitvalue}
-	}()
-	// Start another goroutine to signal a timeout
-	timech := make(chan bool, 1)
-	if timeout.Seconds() != 0 {
-		go func() {
-			time.Sleep(timeout)
-			timech <- true
-		}()
 	}
 
-	// Read from the channels, select will give us whichever one returns first
+	// Failed attempts are retried if --retries was specified.  Output from every
+	// attempt is collected, and only the result of the final attempt counts.
 	var output []byte
 	var exitvalue int
-	select {
-	case combinedOutput := <-resch:
-		output = combinedOutput.output
-		exitvalue = combinedOutput.exitvalue
-	case <-timech:
-		if debug {
-			fmt.Printf("Process timed out, sending SIGTERM\n")
+	var signal syscall.Signal
+	timedout := false
+	startfailed := false
+	start := time.Now()
+	attempts := 0
+
+	// A failing pre hook aborts the run, and counts as a failure of the job.
+	// Output from the hook is reported along with the job's.
+	prefailed := false
+	if prehook != "" {
+		var hooktimedout bool
+		output, exitvalue, hooktimedout = runHook(prehook, runenv)
+		if exitvalue != 0 || hooktimedout {
+			prefailed = true
+			if hooktimedout {
+				output = append(output, fmt.Sprintf("cronwrap: pre hook timed out after %s, not running job\n", hooktimeout)...)
+			} else {
+				output = append(output, fmt.Sprintf("cronwrap: pre hook failed with exit value %d, not running job\n", exitvalue)...)
+			}
 		}
-		cmd := <-cmdch
-		// cmd.Process.Kill() sends SIGKILL
-		// We want to try to be more graceful so we start with SIGTERM
-		needskill := true
-		_ = cmd.Process.Signal(syscall.SIGTERM)
-		for i := 0; i < 5; i++ {
-			var waitstat syscall.WaitStatus
-			waitpid, _ := syscall.Wait4(cmd.Process.Pid, &waitstat, syscall.WNOHANG, nil)
-			if waitpid != 0 {
-				needskill = false
+	}
+
+	// The job is told how many times it has failed so far, so that it can be
+	// more verbose after repeated failures, and about its span so it can attach
+	// its own spans to the trace
+	jobenv := append(jobEnvironment(), runenv...)
+	jobenv = append(jobenv, "CRONWRAP_FAILCOUNT="+strconv.Itoa(state.FailCount))
+	jobspanid := newSpanID()
+	if otlpendpoint != "" {
+		jobenv = append(jobenv, "TRACEPARENT=00-"+traceid+"-"+jobspanid+"-01")
+	}
+
+	command := flag.Args()
+	// The pre hook has its own timeout, so the job's timeout starts now
+	execstart := time.Now()
+	deadline := execstart.Add(timeout)
+
+	for attempt := 1; !prefailed; attempt++ {
+		attempttimeout := timeout
+		if timeout.Seconds() != 0 && !timeoutperattempt {
+			attempttimeout = deadline.Sub(time.Now())
+			if attempttimeout <= 0 {
+				// There's no time left to start another attempt.  Zero would
+				// mean no timeout at all, and anything less than a moment would
+				// kill the job before it got going.
+				exitvalue = 1
+				signal = 0
+				timedout = true
 				break
 			}
-			time.Sleep(time.Duration(1) * time.Second)
 		}
-		if needskill {
+		attempts = attempt
+		attemptenv := append([]string{}, jobenv...)
+		attemptenv = append(attemptenv, "CRONWRAP_ATTEMPT="+strconv.Itoa(attempt))
+		if attempttimeout != 0 {
+			attemptenv = append(attemptenv, "CRONWRAP_DEADLINE="+time.Now().Add(attempttimeout).Format(time.RFC3339))
+		}
+		var attemptoutput []byte
+		attemptoutput, exitvalue, signal, timedout, startfailed = runJob(command, attemptenv, attempttimeout)
+		output = append(output, attemptoutput...)
+		if timedout {
+			// The time left before an overall timeout is a moment less than the
+			// timeout itself for the first attempt, so round it off
+			logEvent(logwarning, "timeout", fmt.Sprintf("Job %s timed out after %s", jobname, attempttimeout.Round(time.Millisecond)),
+				map[string]string{"attempt": strconv.Itoa(attempt)})
+		}
+		exitfields := map[string]string{"attempt": strconv.Itoa(attempt), "exit_status": strconv.Itoa(exitvalue)}
+		if signal != 0 {
+			exitfields["signal"] = signalName(signal)
+		}
+		logEvent(loginfo, "exit", fmt.Sprintf("Job %s exited with exit value %d", jobname, exitvalue), exitfields)
+
+		if attempt > retries || (classify(exitvalue, signal, timedout) != "failure" && !startfailed) {
+			break
+		}
+		if timedout && !timeoutperattempt {
+			break
+		}
+		delay := retryDelay(attempt)
+		if timeout.Seconds() != 0 && !timeoutperattempt && time.Now().Add(delay).After(deadline) {
 			if debug {
-				fmt.Printf("Process did not die, sending SIGKILL\n")
+				fmt.Printf("Not enough time left before timeout to retry\n")
 			}
-			_ = cmd.Process.Kill()
+			break
+		}
+		note := fmt.Sprintf("cronwrap: attempt %d of %d failed with exit value %d, retrying in %s\n", attempt, retries+1, exitvalue, delay)
+		if timedout {
+			note = fmt.Sprintf("cronwrap: attempt %d of %d timed out after %s, retrying in %s\n", attempt, retries+1, attempttimeout, delay)
 		}
 		if debug {
-			fmt.Printf("Process timed out, terminated\n")
+			fmt.Print(note)
 		}
-		exitvalue = 1
+		output = append(output, note...)
+		time.Sleep(delay)
+	}
+
+	if timedout {
+		output = append(output, fmt.Sprintf("cronwrap: job timed out after %s\n", timeout)...)
+	}
+
+	if attempts != 0 {
+		addSpan("job", jobspanid, execstart, time.Now(), attribute("process.exit.code", exitvalue),
+			attribute("cronwrap.timed_out", timedout), attribute("cronwrap.attempts", attempts))
 	}
 
 	if overlap {
@@ -267,36 +690,74 @@ func main() {
 	// Failure suppression
 	//
 
-	failcountfilename := path.Join(jobdir, "failcount")
+	result := classify(exitvalue, signal, timedout)
+	if prefailed || startfailed {
+		result = "failure"
+	}
+	if debug {
+		fmt.Printf("Job result is %s\n", result)
+	}
+
+	// The run lock stops gc removing the job's state while it runs, but if the
+	// state is gone anyway start it afresh rather than lose the job's output
+	_ = os.MkdirAll(jobdir, 0755)
+
+	// Copies of the job run without overlap protection may finish at the same
+	// time, so hold a lock while we update the failure count and other state
+	statelock = lockState(jobdir)
+	newstate, err := readState(jobdir)
+	if err == nil {
+		state = newstate
+	} else if stateerr == nil {
+		fmt.Fprintf(os.Stderr, "cronwrap: %s, using state from before the job ran\n", err)
+		stateerr = err
+	}
+
+	end := time.Now()
 	suppress_failure := false
-	var failcount int
-	if exitvalue == 0 {
-		failcount = 0
-		if suppress != 0 {
+	if result == "skip" {
+		// Leave the failure count and the time of the first failure alone, the
+		// job neither succeeded nor failed
+		if suppress != 0 || suppressfor != 0 {
+			if debug {
+				fmt.Printf("Suppressing output\n")
+			}
+			suppress_failure = true
+		}
+	} else if result == "success" {
+		state.FailCount = 0
+		// The streak of failures, if any, is over
+		state.FirstFailure = nil
+		// Record the success for check-stale
+		state.LastSuccess = &end
+		if suppress != 0 || suppressfor != 0 {
 			if debug {
 				fmt.Printf("Suppressing output\n")
 			}
 			suppress_failure = true
 		}
 	} else {
-		// Get existing failcount for this job and increment by one
-		oldcount := 0
+		// Increment the failcount for this job
 		if debug {
-			fmt.Printf("Reading old failure count\n")
+			fmt.Printf("Old failure count is %d\n", state.FailCount)
 		}
-		oldcountbytes, err := ioutil.ReadFile(failcountfilename)
-		if err == nil {
-			oldcountstring := string(oldcountbytes)
-			_, _ = fmt.Sscanf(strings.TrimSpace(oldcountstring), "%d", &oldcount)
-			if debug {
-				fmt.Printf("Old failure count is %d\n", oldcount)
-			}
+		state.FailCount++
+		if debug {
+			fmt.Printf("Failure count for this job is %d\n", state.FailCount)
+		}
+
+		// Record the time of the first failure in the current streak of failures
+		if state.FailCount == 1 || state.FirstFailure == nil {
+			state.FirstFailure = &end
 		}
-		failcount = oldcount + 1
+		firstfail := *state.FirstFailure
 		if debug {
-			fmt.Printf("Failure count for this job is %d\n", failcount)
+			fmt.Printf("Job has been failing since %s\n", firstfail.Format(time.RFC3339))
 		}
-		if suppress != 0 && failcount < suppress {
+
+		// If both --suppress and --suppress-for are specified then the job has to
+		// exceed both thresholds before we stop suppressing its failures
+		if (suppress != 0 && state.FailCount < suppress) || (suppressfor != 0 && time.Since(firstfail) < suppressfor) {
 			if debug {
 				fmt.Printf("Suppressing output\n")
 			}
@@ -304,31 +765,2024 @@ func main() {
 		}
 	}
 
-	if debug {
-		fmt.Printf("Saving failure count for this job\n")
+	//
+	// Flapping detection
+	//
+	// A job that alternates between success and failure may never reach the
+	// --suppress threshold of consecutive failures.  Keep a record of the results
+	// of the last few runs and report failures if too many of them failed.
+	//
+
+	if flapwindow != 0 && result != "skip" {
+		outcomes := state.Outcomes
+		if result == "success" {
+			outcomes += "S"
+		} else {
+			outcomes += "F"
+		}
+		if len(outcomes) > flapwindow {
+			outcomes = outcomes[len(outcomes)-flapwindow:]
+		}
+		state.Outcomes = outcomes
+
+		failures := strings.Count(outcomes, "F")
+		ratio := float64(failures) / float64(flapwindow)
+		if debug {
+			fmt.Printf("Job failed %d of the last %d runs\n", failures, len(outcomes))
+		}
+		// Don't make a judgement until we've seen a full window of runs
+		if len(outcomes) == flapwindow && ratio > flapthreshold && result == "failure" {
+			if suppress_failure {
+				if debug {
+					fmt.Printf("Job is flapping, not suppressing output\n")
+				}
+				suppress_failure = false
+			}
+			output = append(output, fmt.Sprintf("cronwrap: job failed %d of the last %d runs\n", failures, flapwindow)...)
+		}
 	}
-	file, err := os.Create(failcountfilename)
-	check(err)
-	_, err = file.WriteString(fmt.Sprintf("%d", failcount))
-	check(err)
-	err = file.Close()
-	check(err)
 
-	if suppress_failure {
-		os.Exit(0)
-	} else {
-		_, _ = os.Stdout.Write(output)
-		os.Exit(exitvalue)
+	if result == "failure" {
+		fields := map[string]string{"failcount": strconv.Itoa(state.FailCount)}
+		if suppress_failure {
+			logEvent(lognotice, "suppressed", fmt.Sprintf("Suppressing failure %d of job %s", state.FailCount, jobname), fields)
+		} else {
+			logEvent(logerr, "failed", fmt.Sprintf("Reporting failure %d of job %s", state.FailCount, jobname), fields)
+		}
 	}
-}
 
-func check(e error) {
-	if e != nil {
-		if debug {
-			panic(e)
+	// Note the first failure we report in a streak of failures, and the end of
+	// that streak, for the on-failure and on-recovery hooks
+	reportedfailure := false
+	recovered := false
+	if result == "failure" && !suppress_failure && !state.FailureReported {
+		state.FailureReported = true
+		reportedfailure = true
+	} else if result == "success" && state.FailureReported {
+		state.FailureReported = false
+		recovered = true
+	}
+
+	exitstatus := 0
+	if result == "failure" && !suppress_failure {
+		if exitvalue == 0 {
+			// The job's exit code was declared to be a failure, but we can't
+			// report that by passing it through
+			exitstatus = 1
 		} else {
-			fmt.Fprintln(os.Stderr, e)
-			os.Exit(1)
+			exitstatus = exitvalue
 		}
 	}
+
+	if debug {
+		fmt.Printf("Saving state for this job\n")
+	}
+	state.LastRun = &end
+	state.LastResult = result
+	state.LastExitStatus = exitvalue
+	state.LastDuration = end.Sub(start).Seconds()
+	err = writeState(jobdir, state)
+	if err != nil && stateerr == nil {
+		fmt.Fprintf(os.Stderr, "cronwrap: unable to save state: %s\n", err)
+	}
+
+	// Don't hold the lock while hooks run
+	err = statelock.Close()
+	check(err)
+
+	//
+	// History
+	//
+	// The record is written once hooks have run so that it includes their
+	// failures
+	//
+
+	record := historyRecord{
+		Start:      start,
+		End:        end,
+		Duration:   end.Sub(start).Seconds(),
+		Attempts:   attempts,
+		Result:     result,
+		ExitStatus: exitvalue,
+		TimedOut:   timedout,
+		Suppressed: suppress_failure,
+		OutputSize: len(output),
+		RunID:      runid,
+		Version:    ver,
+	}
+	if signal != 0 {
+		record.Signal = signalName(signal)
+	}
+
+	//
+	// Hooks
+	//
+	// Hooks are told about the outcome of the run through environment
+	// variables, and can read the job's output from a file.  Their failures are
+	// reported as warnings and recorded in the history, they don't change the
+	// job's status.
+	//
+
+	type hook struct {
+		name    string
+		command string
+	}
+	var hooks []hook
+	if failurehook != "" && reportedfailure {
+		hooks = append(hooks, hook{"on-failure", failurehook})
+	}
+	if recoveryhook != "" && recovered {
+		hooks = append(hooks, hook{"on-recovery", recoveryhook})
+	}
+	if posthook != "" {
+		hooks = append(hooks, hook{"post", posthook})
+	}
+	if len(hooks) != 0 {
+		// Problems with the file of output for the hooks are reported like
+		// other problems with hooks, rather than losing the job's result.  The
+		// hooks are still run, without the file.
+		outputfilename := ""
+		outputfile, err := ioutil.TempFile(jobdir, "output")
+		if err == nil {
+			outputfilename = outputfile.Name()
+			_, err = outputfile.Write(output)
+			closeerr := outputfile.Close()
+			if err == nil {
+				err = closeerr
+			}
+			if err != nil {
+				_ = os.Remove(outputfilename)
+				outputfilename = ""
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to save output for hooks: %s\n", err)
+		}
+		hookenv := append([]string{}, runenv...)
+		hookenv = append(hookenv,
+			"CRONWRAP_RESULT="+result,
+			"CRONWRAP_EXIT_STATUS="+strconv.Itoa(exitvalue),
+			"CRONWRAP_SIGNAL="+record.Signal,
+			"CRONWRAP_DURATION="+strconv.FormatFloat(record.Duration, 'f', 3, 64),
+			"CRONWRAP_TIMED_OUT="+strconv.FormatBool(timedout),
+			"CRONWRAP_SUPPRESSED="+strconv.FormatBool(suppress_failure),
+			"CRONWRAP_FAILCOUNT="+strconv.Itoa(state.FailCount),
+		)
+		if outputfilename != "" {
+			hookenv = append(hookenv, "CRONWRAP_OUTPUT="+outputfilename)
+		}
+		if state.FirstFailure != nil {
+			hookenv = append(hookenv, "CRONWRAP_FIRST_FAILURE="+state.FirstFailure.Format(time.RFC3339))
+		}
+		for _, h := range hooks {
+			hookoutput, hookexitvalue, hooktimedout := runHook(h.command, hookenv)
+			message := ""
+			if hooktimedout {
+				message = fmt.Sprintf("%s hook timed out after %s", h.name, hooktimeout)
+			} else if hookexitvalue != 0 {
+				message = fmt.Sprintf("%s hook failed with exit value %d", h.name, hookexitvalue)
+			} else {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "cronwrap: %s\n", message)
+			_, _ = os.Stderr.Write(hookoutput)
+			logEvent(logerr, "hook_failed", message, map[string]string{"hook": h.name})
+			record.HookFailures = append(record.HookFailures, h.name)
+		}
+		// The post hook may well have cleaned up the file itself
+		if outputfilename != "" {
+			err = os.Remove(outputfilename)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "cronwrap: unable to remove output for hooks: %s\n", err)
+			}
+		}
+	}
+
+	statelock = lockState(jobdir)
+	writeHistory(jobdir, record)
+	err = statelock.Close()
+	check(err)
+
+	//
+	// Metrics
+	//
+	// Problems reporting metrics shouldn't affect the job's status, so they are
+	// only reported as warnings
+	//
+
+	if metricsdir != "" {
+		metricsfilename := path.Join(metricsdir, jobid+".prom")
+		if debug {
+			fmt.Printf("Writing metrics to %s\n", metricsfilename)
+		}
+		err = writeFileAtomic(metricsfilename, []byte(prometheusMetrics(jobname, record, state)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to write metrics: %s\n", err)
+		}
+	}
+	if pushurl != "" {
+		err = pushMetrics(jobname, prometheusMetrics(jobname, record, state))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to push metrics: %s\n", err)
+		}
+	}
+	if statsdaddr != "" {
+		metrics := []string{
+			"runs:1|c",
+			fmt.Sprintf("duration:%d|ms", end.Sub(start).Nanoseconds()/int64(time.Millisecond)),
+		}
+		if result == "failure" {
+			metrics = append(metrics, "failures:1|c")
+			if suppress_failure {
+				metrics = append(metrics, "suppressed_failures:1|c")
+			}
+		}
+		if timedout {
+			metrics = append(metrics, "timeouts:1|c")
+		}
+		sendStatsd(jobname, metrics)
+	}
+	if otlpendpoint != "" {
+		err = sendTrace(jobname, tracestart, result == "failure",
+			attribute("process.command_line", cmdAsString),
+			attribute("process.exit.code", exitvalue),
+			attribute("cronwrap.result", result),
+			attribute("cronwrap.timed_out", timedout),
+			attribute("cronwrap.suppressed", suppress_failure))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to send trace: %s\n", err)
+		}
+	}
+
+	//
+	// Notifications
+	//
+	// External monitoring is told about every run, even if failures are being
+	// suppressed locally.  As with metrics, problems sending notifications
+	// don't affect the job's status.
+	//
+
+	if result == "failure" && pingfailure != "" {
+		code := exitvalue
+		if code == 0 {
+			code = 1
+		}
+		err = ping(fmt.Sprintf("%s/%d", strings.TrimRight(pingfailure, "/"), code), outputTail(output, outputtail))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to send failure ping: %s\n", err)
+		}
+	} else if result != "failure" && pingsuccess != "" {
+		err = ping(strings.TrimRight(pingsuccess, "/")+"/0", outputTail(output, outputtail))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to send success ping: %s\n", err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	report := runReport{
+		Job:        jobname,
+		Host:       hostname,
+		Command:    cmdAsString,
+		Result:     result,
+		ExitStatus: exitvalue,
+		Signal:     record.Signal,
+		TimedOut:   timedout,
+		Duration:   record.Duration,
+		FailCount:  state.FailCount,
+		Output:     string(outputTail(output, outputtail)),
+	}
+	if result == "failure" && !suppress_failure && webhookurl != "" {
+		err = sendWebhook(report, webhooktemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to send webhook: %s\n", err)
+		}
+	}
+
+	// Mail whatever we'd otherwise leave for cron to mail.  The mail contains all
+	// of the output, not just the end of it.  If the mail can't be sent the output
+	// is still written so that it isn't lost.
+	if len(mailto) != 0 && !suppress_failure && len(output) != 0 {
+		report.Output = string(output)
+		err = sendMail(report)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to send mail: %s\n", err)
+		} else {
+			output = nil
+		}
+	}
+
+	if !suppress_failure {
+		_, _ = os.Stdout.Write(output)
+	}
+	_ = runlock.Close()
+	os.Exit(exitstatus)
+}
+
+// One line in a job's history file
+type historyRecord struct {
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	Duration       float64   `json:"duration"`
+	Attempts       int       `json:"attempts"`
+	Result         string    `json:"result"`
+	ExitStatus     int       `json:"exit_status"`
+	Signal         string    `json:"signal,omitempty"`
+	TimedOut       bool      `json:"timed_out"`
+	Suppressed     bool      `json:"suppressed"`
+	OverlapSkipped bool      `json:"overlap_skipped"`
+	OutputSize     int       `json:"output_size"`
+	RunID          string    `json:"run_id"`
+	HookFailures   []string  `json:"hook_failures,omitempty"`
+	Hostname       string    `json:"hostname"`
+	Version        string    `json:"version"`
+}
+
+// prometheusMetrics formats metrics about the run of the job in the Prometheus
+// text exposition format
+func prometheusMetrics(jobname string, record historyRecord, state jobState) string {
+	// Label values are quoted, with backslash, double quote and newline escaped
+	label := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(jobname)
+	lastsuccess := 0.0
+	if state.LastSuccess != nil {
+		lastsuccess = float64(state.LastSuccess.UnixNano()) / 1e9
+	}
+	timedout := 0.0
+	if record.TimedOut {
+		timedout = 1
+	}
+
+	metrics := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"cronwrap_last_start_timestamp_seconds", "Time the job last started", float64(record.Start.UnixNano()) / 1e9},
+		{"cronwrap_last_end_timestamp_seconds", "Time the job last finished", float64(record.End.UnixNano()) / 1e9},
+		{"cronwrap_last_duration_seconds", "How long the job last ran", record.Duration},
+		{"cronwrap_last_exit_code", "Exit value of the last run of the job", float64(record.ExitStatus)},
+		{"cronwrap_consecutive_failures", "Number of consecutive failures of the job", float64(state.FailCount)},
+		{"cronwrap_last_success_timestamp_seconds", "Time the job last succeeded, 0 if never", lastsuccess},
+		{"cronwrap_last_timed_out", "Whether the last run of the job timed out", timedout},
+	}
+	var buffer bytes.Buffer
+	for _, metric := range metrics {
+		fmt.Fprintf(&buffer, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(&buffer, "# TYPE %s gauge\n", metric.name)
+		fmt.Fprintf(&buffer, "%s{cronjob=\"%s\"} %s\n", metric.name, label, strconv.FormatFloat(metric.value, 'f', -1, 64))
+	}
+	return buffer.String()
+}
+
+// pushMetrics sends metrics to a Prometheus Pushgateway, grouped by job and
+// instance.  Each job is its own group by default, so the metrics replace any
+// previously pushed for the group.
+func pushMetrics(jobname string, metrics string) error {
+	group := pushjob
+	if group == "" {
+		group = jobname
+	}
+	instance := pushinstance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	// Command lines are likely to contain slashes, so always use the base64
+	// encoding the Pushgateway supports for grouping label values
+	url := strings.TrimRight(pushurl, "/") + "/metrics/job@base64/" + base64.URLEncoding.EncodeToString([]byte(group)) + "/instance@base64/" + base64.URLEncoding.EncodeToString([]byte(instance))
+	if debug {
+		fmt.Printf("Pushing metrics to %s\n", url)
+	}
+
+	request, err := http.NewRequest("PUT", url, strings.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: pushtimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", pushurl, response.Status)
+	}
+	return nil
+}
+
+// sendStatsd sends metrics, i.e. "runs:1|c", to the StatsD agent in a single
+// UDP packet.  This is fire and forget, errors are only reported in debug mode.
+// Plain StatsD doesn't support tags, so in that format the prefix is the only
+// way to distinguish jobs.  DogStatsD metrics are tagged with the job name and
+// any tags given by the user.
+func sendStatsd(jobname string, metrics []string) {
+	tags := ""
+	if statsdformat == "dogstatsd" {
+		// Commas and pipes delimit tags and fields
+		jobtag := "job:" + strings.NewReplacer(",", "_", "|", "_").Replace(jobname)
+		tags = "|#" + jobtag
+		if statsdtags != "" {
+			tags += "," + statsdtags
+		}
+	}
+
+	lines := make([]string, len(metrics))
+	for i, metric := range metrics {
+		lines[i] = statsdprefix + metric + tags
+	}
+	packet := strings.Join(lines, "\n")
+	if debug {
+		fmt.Printf("Sending metrics to StatsD at %s:\n%s\n", statsdaddr, packet)
+	}
+
+	conn, err := net.Dial("udp", statsdaddr)
+	if err == nil {
+		_, err = conn.Write([]byte(packet))
+		_ = conn.Close()
+	}
+	if err != nil && debug {
+		fmt.Printf("Unable to send metrics to StatsD: %s\n", err)
+	}
+}
+
+// Syslog severities of lifecycle events, journald uses the same priorities
+const (
+	logerr     = 3
+	logwarning = 4
+	lognotice  = 5
+	loginfo    = 6
+)
+
+// Syslog facility for lifecycle events
+const logfacility = 9 // cron
+
+// Fields identifying the job that are added to every lifecycle event
+var logfields = map[string]string{}
+var logconn net.Conn
+var logstream bool
+
+// logEvent logs a lifecycle event, with the job's fields and any specific to
+// the event, to syslog or journald if --log was specified.  If the log can't
+// be reached a warning is printed once and logging is disabled, it mustn't get
+// in the way of running the job.
+func logEvent(severity int, event string, message string, fields map[string]string) {
+	if logto == "" {
+		return
+	}
+	if logconn == nil {
+		socket := logsocket
+		if socket == "" && logto == "syslog" {
+			socket = "/dev/log"
+		} else if socket == "" {
+			socket = "/run/systemd/journal/socket"
+		}
+		conn, err := net.Dial("unixgram", socket)
+		if err != nil && logto == "syslog" {
+			// Some syslog daemons only listen on a stream socket
+			conn, err = net.Dial("unix", socket)
+			logstream = true
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cronwrap: unable to log to %s: %s\n", logto, err)
+			logto = ""
+			return
+		}
+		logconn = conn
+	}
+
+	all := map[string]string{"event": event}
+	for key, value := range logfields {
+		all[key] = value
+	}
+	for key, value := range fields {
+		all[key] = value
+	}
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var packet bytes.Buffer
+	if logto == "syslog" {
+		// RFC 5424, with the fields as structured data.  32473 is the private
+		// enterprise number reserved for documentation.
+		hostname, _ := os.Hostname()
+		fmt.Fprintf(&packet, "<%d>1 %s %s cronwrap %d %s [cronwrap@32473", logfacility*8+severity,
+			time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), hostname, os.Getpid(), event)
+		escaper := strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+		for _, key := range keys {
+			fmt.Fprintf(&packet, ` %s="%s"`, key, escaper.Replace(all[key]))
+		}
+		fmt.Fprintf(&packet, "] %s", message)
+		if logstream {
+			packet.WriteString("\n")
+		}
+	} else {
+		// The journal's native protocol.  Values containing newlines have to be
+		// sent with an explicit length.
+		field := func(key string, value string) {
+			if strings.Contains(value, "\n") {
+				packet.WriteString(key + "\n")
+				_ = binary.Write(&packet, binary.LittleEndian, uint64(len(value)))
+				packet.WriteString(value + "\n")
+			} else {
+				packet.WriteString(key + "=" + value + "\n")
+			}
+		}
+		field("MESSAGE", message)
+		field("PRIORITY", strconv.Itoa(severity))
+		field("SYSLOG_FACILITY", strconv.Itoa(logfacility))
+		field("SYSLOG_IDENTIFIER", "cronwrap")
+		for _, key := range keys {
+			field("CRONWRAP_"+strings.ToUpper(key), all[key])
+		}
+	}
+
+	_, err := logconn.Write(packet.Bytes())
+	if err != nil && debug {
+		fmt.Printf("Unable to log to %s: %s\n", logto, err)
+	}
+}
+
+// The trace of this run, and the span of whatever started us if it passed on
+// its trace context
+var traceid string
+var rootspanid string
+var parentspanid string
+var spans []otlpSpan
+
+var validtraceparent = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// A span in OTLP's JSON encoding
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+// attribute makes a span attribute of a string, bool, int or float64
+func attribute(key string, value interface{}) otlpAttribute {
+	switch value := value.(type) {
+	case bool:
+		return otlpAttribute{key, map[string]interface{}{"boolValue": value}}
+	case int:
+		// 64 bit integers are encoded as strings in JSON
+		return otlpAttribute{key, map[string]interface{}{"intValue": strconv.Itoa(value)}}
+	case float64:
+		return otlpAttribute{key, map[string]interface{}{"doubleValue": value}}
+	default:
+		return otlpAttribute{key, map[string]interface{}{"stringValue": fmt.Sprint(value)}}
+	}
+}
+
+// randomID returns n random bytes in hex.  math/rand is seeded for jitter so
+// isn't any use for this.
+func randomID(n int) string {
+	bytes := make([]byte, n)
+	_, err := crand.Read(bytes)
+	check(err)
+	return fmt.Sprintf("%x", bytes)
+}
+
+func newSpanID() string {
+	return randomID(8)
+}
+
+// startTrace starts the trace of this run, as part of the trace in a W3C
+// traceparent if there is a valid one
+func startTrace(traceparent string) {
+	matches := validtraceparent.FindStringSubmatch(traceparent)
+	if matches != nil && strings.Trim(matches[1], "0") != "" && strings.Trim(matches[2], "0") != "" {
+		traceid = matches[1]
+		parentspanid = matches[2]
+	} else {
+		traceid = randomID(16)
+	}
+	rootspanid = newSpanID()
+}
+
+// addSpan adds a child of the root span to the trace, if we're tracing
+func addSpan(name string, spanid string, start time.Time, end time.Time, attributes ...otlpAttribute) {
+	if otlpendpoint == "" {
+		return
+	}
+	spans = append(spans, otlpSpan{
+		TraceID:           traceid,
+		SpanID:            spanid,
+		ParentSpanID:      rootspanid,
+		Name:              name,
+		Kind:              1, // internal
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        attributes,
+	})
+}
+
+// sendTrace ends the root span of the trace, and sends it and its children to
+// the OTLP collector
+func sendTrace(jobname string, start time.Time, failed bool, attributes ...otlpAttribute) error {
+	root := otlpSpan{
+		TraceID:           traceid,
+		SpanID:            rootspanid,
+		ParentSpanID:      parentspanid,
+		Name:              "cronwrap " + jobname,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        append([]otlpAttribute{attribute("cronwrap.job", jobname)}, attributes...),
+	}
+	if failed {
+		root.Status = &otlpStatus{Code: 2} // error
+	}
+
+	hostname, _ := os.Hostname()
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						attribute("service.name", "cronwrap"),
+						attribute("host.name", hostname),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "cronwrap"},
+						"spans": append([]otlpSpan{root}, spans...),
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if debug {
+		fmt.Printf("Sending trace %s to %s\n", traceid, otlpendpoint)
+	}
+	client := &http.Client{Timeout: otlptimeout}
+	response, err := client.Post(otlpendpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", otlpendpoint, response.Status)
+	}
+	return nil
+}
+
+// Details of a run of the job, sent to webhooks and mail recipients and
+// available to their templates
+type runReport struct {
+	Job        string  `json:"job"`
+	Host       string  `json:"host"`
+	Command    string  `json:"command"`
+	Result     string  `json:"result"`
+	ExitStatus int     `json:"exit_status"`
+	Signal     string  `json:"signal,omitempty"`
+	TimedOut   bool    `json:"timed_out"`
+	Duration   float64 `json:"duration"`
+	FailCount  int     `json:"failcount"`
+	Output     string  `json:"output"`
+}
+
+// Functions available to templates.  json quotes a value for use in a JSON
+// document, i.e. {"text": {{json .Output}}}.
+var templatefuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		bytes, err := json.Marshal(value)
+		return string(bytes), err
+	},
+}
+
+// sendWebhook POSTs the report to the webhook URL, either as JSON or formatted
+// by the user's template for services like Slack that expect their own format
+func sendWebhook(report runReport, tmpl *template.Template) error {
+	var body bytes.Buffer
+	if tmpl != nil {
+		err := tmpl.Execute(&body, report)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := json.NewEncoder(&body).Encode(report)
+		if err != nil {
+			return err
+		}
+	}
+	if debug {
+		fmt.Printf("Sending webhook to %s\n", webhookurl)
+	}
+
+	request, err := http.NewRequest("POST", webhookurl, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for _, header := range webhookheaders {
+		i := strings.Index(header, ":")
+		request.Header.Set(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+	}
+	client := &http.Client{Timeout: webhooktimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", webhookurl, response.Status)
+	}
+	return nil
+}
+
+// sendMail mails the report, with the job's output as the body, either via
+// SMTP or by handing it to sendmail
+func sendMail(report runReport) error {
+	from := mailfrom
+	if from == "" {
+		username := strconv.Itoa(os.Geteuid())
+		currentuser, err := user.Current()
+		if err == nil {
+			username = currentuser.Username
+		}
+		from = username + "@" + report.Host
+	}
+	var subject bytes.Buffer
+	err := mailsubjecttemplate.Execute(&subject, report)
+	if err != nil {
+		return err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(mailto, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject.String()))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&message, "\r\n")
+	message.WriteString(strings.Replace(report.Output, "\n", "\r\n", -1))
+
+	if smtpaddr == "" {
+		if debug {
+			fmt.Printf("Sending mail via %s\n", sendmail)
+		}
+		cmd := exec.Command(sendmail, append([]string{"-oi", "-f", from, "--"}, mailto...)...)
+		cmd.Stdin = &message
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s %s", sendmail, err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	if debug {
+		fmt.Printf("Sending mail via SMTP server %s\n", smtpaddr)
+	}
+	client, err := smtp.Dial(smtpaddr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	host, _, err := net.SplitHostPort(smtpaddr)
+	if err != nil {
+		return err
+	}
+	if smtpstarttls {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if smtpuser != "" {
+		err = client.Auth(smtp.PlainAuth("", smtpuser, os.Getenv("CRONWRAP_SMTP_PASSWORD"), host))
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range mailto {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message.Bytes())
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// How much of the end of the job's output to send with pings and other
+// notifications
+const outputtail = 10000
+
+// How many times to try each ping
+const pingattempts = 3
+
+// ping sends a healthchecks.io style ping, POSTing the body to the URL.  The
+// ping is retried a few times as it is likely that the monitoring service is
+// only briefly unavailable.
+func ping(url string, body []byte) error {
+	client := &http.Client{Timeout: pingtimeout}
+	var err error
+	for attempt := 1; attempt <= pingattempts; attempt++ {
+		if debug {
+			fmt.Printf("Pinging %s\n", url)
+		}
+		var response *http.Response
+		response, err = client.Post(url, "text/plain", bytes.NewReader(body))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode/100 == 2 {
+				return nil
+			}
+			err = fmt.Errorf("%s returned %s", url, response.Status)
+		}
+		if debug {
+			fmt.Printf("Ping failed: %s\n", err)
+		}
+		if attempt < pingattempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+// outputTail returns at most the last size bytes of the job's output
+func outputTail(output []byte, size int) []byte {
+	if len(output) > size {
+		return output[len(output)-size:]
+	}
+	return output
+}
+
+// writeHistory appends a record of this run to the job's history file,
+// rotating the file first if it has grown larger than --history-size.  Failing
+// to record history isn't worth failing the job over, so errors are only
+// reported in debug mode.
+func writeHistory(jobdir string, record historyRecord) {
+	if historysize == 0 {
+		return
+	}
+	if record.Hostname == "" {
+		record.Hostname, _ = os.Hostname()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		if debug {
+			fmt.Printf("Unable to encode history: %s\n", err)
+		}
+		return
+	}
+
+	historyfilename := path.Join(jobdir, "history")
+	info, err := os.Stat(historyfilename)
+	if err == nil && info.Size()+int64(len(line)) > historysize {
+		if debug {
+			fmt.Printf("Rotating history file\n")
+		}
+		_ = os.Rename(historyfilename, historyfilename+".1")
+	}
+
+	file, err := os.OpenFile(historyfilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = file.Write(append(line, '\n'))
+		closeerr := file.Close()
+		if err == nil {
+			err = closeerr
+		}
+	}
+	if err != nil && debug {
+		fmt.Printf("Unable to write history: %s\n", err)
+	}
+}
+
+// The names of the subcommands
+var subcommands = map[string]bool{"check-stale": true, "status": true, "gc": true}
+
+// findSubcommand looks for a subcommand at the start of the command line,
+// possibly after the options that control where cronwrap keeps its state,
+// which all of the subcommands accept too.  Returns the subcommand, or an
+// empty string if there isn't one, and the arguments for the subcommand
+// including any state options.
+func findSubcommand(args []string) (string, []string) {
+	var stateargs []string
+	for i := 0; i < len(args); i++ {
+		option := strings.SplitN(strings.TrimLeft(args[i], "-"), "=", 2)
+		switch {
+		case subcommands[args[i]]:
+			return args[i], append(stateargs, args[i+1:]...)
+		case !strings.HasPrefix(args[i], "-") || args[i] == "--":
+			return "", nil
+		case option[0] == "system":
+			stateargs = append(stateargs, args[i])
+		case option[0] == "state-dir" && len(option) == 2:
+			stateargs = append(stateargs, args[i])
+		case option[0] == "state-dir" && i+1 < len(args):
+			stateargs = append(stateargs, args[i], args[i+1])
+			i++
+		default:
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// addStateFlags adds the options that control where cronwrap keeps its state
+// to the given set of flags, so that they're available to the subcommands too
+func addStateFlags(flags *flag.FlagSet) {
+	flags.StringVar(&statedir, "state-dir", os.Getenv("CRONWRAP_STATE_DIR"), "Directory for cronwrap's state")
+	flags.BoolVar(&system, "system", false, "Keep state in "+systemdir+", shared by all users")
+}
+
+// workDir returns the directory where cronwrap keeps its state
+func workDir() string {
+	if statedir != "" {
+		return statedir
+	}
+
+	// The system directory is shared by all users on the host, each of whom gets
+	// their own directory within it
+	if system {
+		username := strconv.Itoa(os.Geteuid())
+		currentuser, err := user.Current()
+		if err == nil {
+			username = currentuser.Username
+		}
+		return path.Join(systemdir, username)
+	}
+
+	// This value for workdir is open to debate.  Using a system directory like
+	// /var/lib/cronwrap would restrict cronwrap to use by root, which doesn't seem
+	// desirable.  Using $TMPDIR or other world writable, sticky bit enabled
+	// directories makes it hard for us to come up with a way to identify what
+	// directory cronwrap should use, given that we can't guarantee any specific
+	// filename will be available. I.e. we can't assume /tmp/cronwrap will be
+	// available for us to use.  If one instance uses mktemp and creates
+	// /tmp/cronwrap.45e2f7 how is any other instance to know that's valid?  And we
+	// don't want to lose state to cleanup from tmpwatch or system reboots.  Using
+	// $XDG_STATE_HOME or $HOME for variable/temporary state data isn't ideal, but
+	// it's the best I'm coming up with at the moment.  State in $HOME takes
+	// priority if it exists so that users don't lose it when they start setting
+	// $XDG_STATE_HOME.
+	home := os.Getenv("HOME")
+	homedir := path.Join(home, ".cronwrap")
+	if home != "" {
+		_, err := os.Stat(homedir)
+		if err == nil {
+			return homedir
+		}
+	}
+	if xdg := os.Getenv("XDG_STATE_HOME"); xdg != "" {
+		return path.Join(xdg, "cronwrap")
+	}
+	if home != "" {
+		return homedir
+	}
+	return ""
+}
+
+// prepareWorkDir creates the directory where cronwrap keeps its state if
+// necessary, and returns it
+func prepareWorkDir() string {
+	workdir := workDir()
+	if workdir == "" {
+		check(errors.New("Error: unable to find a directory for state, HOME is not set, use --state-dir"))
+	}
+
+	// A state directory given explicitly takes precedence over --system, i.e.
+	// when a job run with --system runs cronwrap itself and passes on
+	// CRONWRAP_STATE_DIR
+	if !system || statedir != "" {
+		err := os.MkdirAll(workdir, 0755)
+		check(err)
+		return workdir
+	}
+
+	// Only root can write to the system directory, and so only root can create
+	// a user's directory within it.  Were it world writable anyone could create
+	// a directory with someone else's name first and lock them out of it.
+	err := os.MkdirAll(systemdir, 0755)
+	check(err)
+	info, err := os.Stat(systemdir)
+	check(err)
+	if info.Mode().Perm()&0002 != 0 {
+		fmt.Fprintf(os.Stderr, "cronwrap: warning: %s is world writable, anyone can create a directory for another user in it\n", systemdir)
+	}
+	err = os.Mkdir(workdir, 0700)
+	if os.IsPermission(err) {
+		check(fmt.Errorf("%s does not exist, have root create it with: install -d -m 0700 -o %s %s",
+			workdir, path.Base(workdir), workdir))
+	} else if err != nil && !os.IsExist(err) {
+		check(err)
+	}
+
+	// Make sure nobody else created our directory for us, or a symlink to
+	// somewhere else in its place
+	info, err = os.Lstat(workdir)
+	check(err)
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.Mode().IsDir() || !ok || int(stat.Uid) != os.Geteuid() || info.Mode().Perm()&0022 != 0 {
+		check(fmt.Errorf("%s is not a directory owned by and only writable by the current user", workdir))
+	}
+	return workdir
+}
+
+// The version of the state file format written by this version of cronwrap
+const stateversion = 1
+
+// Files used to store state by older versions of cronwrap
+var legacystatefiles = []string{"command", "failcount", "firstfail", "lastsuccess", "maxage", "outcomes"}
+
+// The state of a job that is kept between runs, stored as JSON in the job's
+// directory.  New fields can be added as needed, bump stateversion and add to
+// the migration in readState if existing fields change meaning.
+type jobState struct {
+	Version         int        `json:"version"`
+	Command         string     `json:"command"`
+	FirstSeen       time.Time  `json:"first_seen"`
+	MaxAge          string     `json:"max_age,omitempty"`
+	FailCount       int        `json:"failcount"`
+	FirstFailure    *time.Time `json:"first_failure,omitempty"`
+	LastSuccess     *time.Time `json:"last_success,omitempty"`
+	LastRun         *time.Time `json:"last_run,omitempty"`
+	LastResult      string     `json:"last_result,omitempty"`
+	LastExitStatus  int        `json:"last_exit_status"`
+	LastDuration    float64    `json:"last_duration"`
+	Outcomes        string     `json:"outcomes,omitempty"`
+	FailureReported bool       `json:"failure_reported,omitempty"`
+}
+
+// readState reads the job's state.  If the job has no state file its state is
+// migrated from the separate files used by older versions of cronwrap, and if
+// there are none of those either it is a new job.  If the state can't be read
+// the state of a new job is returned along with the error.
+func readState(jobdir string) (jobState, error) {
+	var state jobState
+	bytes, err := ioutil.ReadFile(path.Join(jobdir, "state.json"))
+	if err == nil {
+		err = json.Unmarshal(bytes, &state)
+		if err != nil {
+			return newState(), fmt.Errorf("Invalid state file in %s: %s", jobdir, err)
+		}
+		if state.Version > stateversion {
+			return newState(), fmt.Errorf("State file in %s is from a newer version of cronwrap", jobdir)
+		}
+		return state, nil
+	} else if !os.IsNotExist(err) {
+		return newState(), err
+	}
+
+	state = newState()
+	commandbytes, err := ioutil.ReadFile(path.Join(jobdir, "command"))
+	if err == nil {
+		state.Command = string(commandbytes)
+		// The command file was written when cronwrap first saw the job
+		info, err := os.Stat(path.Join(jobdir, "command"))
+		if err == nil {
+			state.FirstSeen = info.ModTime()
+		}
+	}
+	failcountbytes, err := ioutil.ReadFile(path.Join(jobdir, "failcount"))
+	if err == nil {
+		_, _ = fmt.Sscanf(strings.TrimSpace(string(failcountbytes)), "%d", &state.FailCount)
+	}
+	firstfail, err := readTimestamp(path.Join(jobdir, "firstfail"))
+	if err == nil {
+		state.FirstFailure = &firstfail
+	}
+	lastsuccess, err := readTimestamp(path.Join(jobdir, "lastsuccess"))
+	if err == nil {
+		state.LastSuccess = &lastsuccess
+	}
+	maxagebytes, err := ioutil.ReadFile(path.Join(jobdir, "maxage"))
+	if err == nil {
+		state.MaxAge = strings.TrimSpace(string(maxagebytes))
+	}
+	outcomesbytes, err := ioutil.ReadFile(path.Join(jobdir, "outcomes"))
+	if err == nil {
+		state.Outcomes = strings.TrimSpace(string(outcomesbytes))
+	}
+	return state, nil
+}
+
+// newState returns the state of a job that cronwrap hasn't seen before
+func newState() jobState {
+	return jobState{Version: stateversion, FirstSeen: time.Now()}
+}
+
+// writeState saves the job's state, and removes any files used to store state
+// by older versions of cronwrap now that their contents have been migrated.
+// State written by a newer version of cronwrap is never overwritten.  Hold the
+// lock from lockState while reading, modifying and writing state.
+func writeState(jobdir string, state jobState) error {
+	var existing struct {
+		Version int `json:"version"`
+	}
+	bytes, err := ioutil.ReadFile(path.Join(jobdir, "state.json"))
+	if err == nil && json.Unmarshal(bytes, &existing) == nil && existing.Version > stateversion {
+		return fmt.Errorf("State file in %s is from a newer version of cronwrap, not replacing it", jobdir)
+	}
+
+	state.Version = stateversion
+	bytes, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(path.Join(jobdir, "state.json"), append(bytes, '\n'))
+	if err != nil {
+		return err
+	}
+	for _, filename := range legacystatefiles {
+		err = os.Remove(path.Join(jobdir, filename))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the contents of the file such that a crash or full
+// disk leaves either the old contents or the new contents, never an empty or
+// truncated file.  The new contents are written to a temporary file in the same
+// directory, which is then renamed over the original.
+func writeFileAtomic(filename string, data []byte) error {
+	file, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	tmpfilename := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeerr := file.Close()
+	if err == nil {
+		err = closeerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfilename, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpfilename)
+		return err
+	}
+
+	// Make sure the rename itself is on disk
+	dir, err := os.Open(path.Dir(filename))
+	if err != nil {
+		return err
+	}
+	_ = dir.Sync()
+	return dir.Close()
+}
+
+// lockState takes an exclusive lock on the job's state, waiting if another
+// copy of the job holds it.  Close the returned file to release the lock.
+func lockState(jobdir string) *os.File {
+	lockfilename := path.Join(jobdir, "lock")
+	lockfile, err := os.OpenFile(lockfilename, os.O_RDONLY|os.O_CREATE, 0644)
+	check(err)
+	if debug {
+		fmt.Printf("Locking state file: %s\n", lockfilename)
+	}
+	err = syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX)
+	check(err)
+	return lockfile
+}
+
+// lockRun takes a shared lock on the job's run lock, which is held for the
+// whole run so that gc can't remove the state of a running job.  gc may have
+// removed the job's directory while we waited for the lock, in which case we
+// start again with a new one.
+func lockRun(jobdir string) *os.File {
+	lockfilename := path.Join(jobdir, "running")
+	for {
+		err := os.MkdirAll(jobdir, 0755)
+		check(err)
+		lockfile, err := os.OpenFile(lockfilename, os.O_RDONLY|os.O_CREATE, 0644)
+		check(err)
+		err = syscall.Flock(int(lockfile.Fd()), syscall.LOCK_SH)
+		check(err)
+		var locked, current syscall.Stat_t
+		err = syscall.Fstat(int(lockfile.Fd()), &locked)
+		check(err)
+		err = syscall.Stat(lockfilename, &current)
+		if err == nil && current.Dev == locked.Dev && current.Ino == locked.Ino {
+			return lockfile
+		}
+		if debug {
+			fmt.Printf("Run lock was removed, trying again\n")
+		}
+		_ = lockfile.Close()
+	}
+}
+
+// How many times, and how often, to retry taking a lock that is held briefly
+// by another copy of status or gc
+const lockretries = 10
+const lockretrydelay = 10 * time.Millisecond
+
+// tryFlock takes an exclusive lock on a file without waiting for it.  status
+// and gc take the same lock for a moment to check whether the job is running,
+// so retry briefly before concluding that a run of the job holds the lock.
+func tryFlock(lockfile *os.File) error {
+	var err error
+	for i := 0; i < lockretries; i++ {
+		err = syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			break
+		}
+		time.Sleep(lockretrydelay)
+	}
+	return err
+}
+
+// tryLock takes an exclusive lock on a file if nobody else holds a lock on it.
+// Close the returned file to release the lock.
+func tryLock(lockfilename string) (*os.File, bool) {
+	lockfile, err := os.OpenFile(lockfilename, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false
+	}
+	err = tryFlock(lockfile)
+	if err != nil {
+		_ = lockfile.Close()
+		return nil, false
+	}
+	return lockfile, true
+}
+
+// runLocked reports whether a run of the job holds its run lock.  The lock is
+// released straight away; a run starting meanwhile waits for it rather than
+// failing.
+func runLocked(jobdir string) bool {
+	lockfile, err := os.Open(path.Join(jobdir, "running"))
+	if err != nil {
+		// Every run creates the run lock before it starts
+		return false
+	}
+	defer lockfile.Close()
+	return tryFlock(lockfile) == syscall.EWOULDBLOCK
+}
+
+// readTimestamp reads a file containing a time in seconds since the epoch
+func readTimestamp(filename string) (time.Time, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var seconds int64
+	_, err = fmt.Sscanf(strings.TrimSpace(string(bytes)), "%d", &seconds)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// checkStale implements the check-stale subcommand, which reports every job
+// that hasn't succeeded within its maximum age.  Returns the exit value.
+func checkStale(args []string) int {
+	flags := flag.NewFlagSet("check-stale", flag.ExitOnError)
+	defaultmaxage := flags.Duration("max-age", 0, "Maximum age for jobs run without --max-age")
+	addStateFlags(flags)
+	flags.Parse(args)
+
+	workdir := workDir()
+	entries, err := ioutil.ReadDir(workdir)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	check(err)
+
+	stale := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		state, err := readState(path.Join(workdir, entry.Name()))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			stale++
+			continue
+		}
+
+		jobmaxage := *defaultmaxage
+		if state.MaxAge != "" {
+			jobmaxage, err = time.ParseDuration(state.MaxAge)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid maximum age in %s: %s\n", path.Join(workdir, entry.Name()), err)
+				stale++
+				continue
+			}
+		}
+		if jobmaxage == 0 {
+			continue
+		}
+
+		command := state.Command
+		if command == "" {
+			command = entry.Name()
+		}
+
+		if state.LastSuccess != nil {
+			if time.Since(*state.LastSuccess) > jobmaxage {
+				fmt.Printf("%s: last succeeded %s, more than %s ago\n", command, state.LastSuccess.Format(time.RFC3339), jobmaxage)
+				stale++
+			}
+			continue
+		}
+
+		// A job that has never succeeded is stale once it has been around longer
+		// than its maximum age
+		if time.Since(state.FirstSeen) > jobmaxage {
+			fmt.Printf("%s: has never succeeded\n", command)
+			stale++
+		}
+	}
+
+	if stale > 0 {
+		return 1
+	}
+	return 0
+}
+
+// The state of a job, as shown by the status subcommand
+type jobStatus struct {
+	Job        string     `json:"job"`
+	Command    string     `json:"command"`
+	JobDir     string     `json:"jobdir"`
+	FirstSeen  time.Time  `json:"first_seen"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastResult string     `json:"last_result,omitempty"`
+	FailCount  int        `json:"failcount"`
+	Running    bool       `json:"running"`
+	PID        int        `json:"pid,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// readJobStatus gathers the state of the job from its directory
+func readJobStatus(jobdir string) jobStatus {
+	// The job's directory is named after its id, which is its name if it has one
+	status := jobStatus{Job: path.Base(jobdir), Command: path.Base(jobdir), JobDir: jobdir}
+
+	state, err := readState(jobdir)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		if state.Command != "" {
+			status.Command = state.Command
+		}
+		status.FirstSeen = state.FirstSeen
+		status.LastRun = state.LastRun
+		status.LastResult = state.LastResult
+		status.FailCount = state.FailCount
+	}
+
+	status.Running = runLocked(jobdir)
+	if !status.Running {
+		return status
+	}
+
+	// Only --overlap jobs have a PID file.  It's left behind if cronwrap was
+	// killed, so it may be from an earlier run than the one holding the run
+	// lock, check that the process is still alive.  Don't lock the PID file
+	// to read it, a copy of the job starting at the same time would think
+	// another copy was running and skip its run.
+	pidbytes, err := ioutil.ReadFile(path.Join(jobdir, "pid"))
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(pidbytes)))
+		if err == nil && pid > 0 {
+			err = syscall.Kill(pid, 0)
+			// EPERM means the process exists but belongs to someone else
+			if err == nil || err == syscall.EPERM {
+				status.PID = pid
+			}
+		}
+	}
+
+	return status
+}
+
+// readJobStatuses gathers the state of every job in the working directory
+func readJobStatuses() []jobStatus {
+	workdir := workDir()
+	entries, err := ioutil.ReadDir(workdir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	check(err)
+
+	var statuses []jobStatus
+	for _, entry := range entries {
+		if entry.IsDir() {
+			statuses = append(statuses, readJobStatus(path.Join(workdir, entry.Name())))
+		}
+	}
+	return statuses
+}
+
+// status implements the status subcommand, which lists every job cronwrap
+// knows about.  Returns the exit value.
+func status(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	jsonoutput := flags.Bool("json", false, "Print status as JSON")
+	addStateFlags(flags)
+	flags.Parse(args)
+
+	statuses := readJobStatuses()
+
+	if *jsonoutput {
+		if statuses == nil {
+			statuses = []jobStatus{}
+		}
+		bytes, err := json.MarshalIndent(statuses, "", "  ")
+		check(err)
+		fmt.Println(string(bytes))
+		return 0
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "LAST RUN\tRESULT\tFAILCOUNT\tPID\tJOB\tCOMMAND")
+	for _, status := range statuses {
+		lastrun := "never"
+		if status.LastRun != nil {
+			lastrun = status.LastRun.Format(time.RFC3339)
+		}
+		result := status.LastResult
+		if result == "" {
+			result = "-"
+		}
+		pid := "-"
+		if status.PID != 0 {
+			pid = strconv.Itoa(status.PID)
+		} else if status.Running {
+			pid = "running"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\t%s\n", lastrun, result, status.FailCount, pid, status.Job, status.Command)
+	}
+	check(writer.Flush())
+	return 0
+}
+
+// lastActivity returns when the job last ran, or when cronwrap first saw a job
+// that never completed a run, and the time of the last run for display
+func lastActivity(firstseen time.Time, lastrun *time.Time) (time.Time, string) {
+	if lastrun == nil {
+		return firstseen, "never"
+	}
+	return *lastrun, lastrun.Format(time.RFC3339)
+}
+
+// gc implements the gc subcommand, which removes the state of jobs that
+// haven't run recently, i.e. jobs that were removed from the crontab or whose
+// command line changed.  Returns the exit value.
+func gc(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	olderthan := flags.Duration("older-than", 30*24*time.Hour, "Remove jobs that haven't run in given time")
+	dryrun := flags.Bool("dry-run", false, "Report what would be removed without removing it")
+	addStateFlags(flags)
+	flags.Parse(args)
+
+	exitvalue := 0
+	for _, status := range readJobStatuses() {
+		// Without the job's state we can't tell when it last ran, and it
+		// may belong to a newer cronwrap, so leave it alone
+		if status.Error != "" {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", status.Command, status.Error)
+			exitvalue = 1
+			continue
+		}
+		since, lastrun := lastActivity(status.FirstSeen, status.LastRun)
+		if time.Since(since) < *olderthan {
+			continue
+		}
+
+		if *dryrun {
+			if runLocked(status.JobDir) {
+				fmt.Printf("Would skip running job %s\n", status.Command)
+			} else {
+				fmt.Printf("Would remove %s, last run %s\n", status.Command, lastrun)
+			}
+			continue
+		}
+
+		// Every run of the job holds a shared lock on its run lock, and holds
+		// the state lock while updating its state.  Hold both while removing
+		// the job's directory so that we can't pull the rug out from under a
+		// copy of the job that is running or starting up.
+		runlock, ok := tryLock(path.Join(status.JobDir, "running"))
+		if !ok {
+			fmt.Printf("Skipping running job %s\n", status.Command)
+			continue
+		}
+		statelock, ok := tryLock(path.Join(status.JobDir, "lock"))
+		if !ok {
+			fmt.Printf("Skipping running job %s\n", status.Command)
+			_ = runlock.Close()
+			continue
+		}
+
+		// The job may have run since we first looked at it, so check again now
+		// that it can't
+		state, err := readState(status.JobDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", status.Command, err)
+			_ = statelock.Close()
+			_ = runlock.Close()
+			exitvalue = 1
+			continue
+		}
+		since, lastrun = lastActivity(state.FirstSeen, state.LastRun)
+		if time.Since(since) < *olderthan {
+			_ = statelock.Close()
+			_ = runlock.Close()
+			continue
+		}
+
+		err = os.RemoveAll(status.JobDir)
+		_ = statelock.Close()
+		_ = runlock.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitvalue = 1
+			continue
+		}
+		fmt.Printf("Removed %s, last run %s\n", status.Command, lastrun)
+	}
+	return exitvalue
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [--] <command> [args...]\n", os.Args[0])
+	// os.Args[0] may be a long path, so only use the program name for the
+	// subcommands to keep these lines reasonably short
+	program := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s check-stale [-max-age duration]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s status [-json]\n", program)
+	fmt.Fprintf(os.Stderr, "       %s gc [-older-than duration] [-dry-run]\n\n", program)
+	for _, name := range basicflags {
+		f := flag.Lookup(name)
+		typename, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(os.Stderr, "  -%-22s %s\n", strings.TrimSpace(name+" "+typename), usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse -help-all to list all options\n")
+}
+
+// A set of exit codes, specified on the command line as a comma separated list
+// of codes and ranges of codes.  I.e. "0,24" or "1,3-5".
+type codeList map[int]bool
+
+func (c codeList) String() string {
+	codes := make([]int, 0, len(c))
+	for code := range c {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	strs := make([]string, len(codes))
+	for i, code := range codes {
+		strs[i] = strconv.Itoa(code)
+	}
+	return strings.Join(strs, ",")
+}
+
+func (c codeList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		first, last := item, item
+		if i := strings.Index(item, "-"); i > 0 {
+			first, last = item[:i], item[i+1:]
+		}
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return fmt.Errorf("invalid exit code %q", item)
+		}
+		end, err := strconv.Atoi(last)
+		if err != nil {
+			return fmt.Errorf("invalid exit code %q", item)
+		}
+		if start < 0 || end > 255 || start > end {
+			return fmt.Errorf("invalid exit code range %q", item)
+		}
+		for code := start; code <= end; code++ {
+			c[code] = true
+		}
+	}
+	return nil
+}
+
+// A list of strings from an option that may be repeated
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// classify returns the result of the job, "success", "failure" or "skip",
+// based on its exit value and the exit codes specified by the user.  A job that
+// timed out or was killed by a signal is always a failure, its exit value is
+// ours rather than one the job chose.
+func classify(exitvalue int, signal syscall.Signal, timedout bool) string {
+	if timedout || signal != 0 {
+		return "failure"
+	}
+	switch {
+	case skipcodes[exitvalue]:
+		return "skip"
+	case successcodes[exitvalue]:
+		return "success"
+	case failurecodes[exitvalue]:
+		return "failure"
+	case len(failurecodes) > 0:
+		// The user told us which codes are failures, so anything else is a
+		// success
+		return "success"
+	case exitvalue == 0:
+		return "success"
+	}
+	return "failure"
+}
+
+func check(e error) {
+	if e != nil {
+		if debug {
+			panic(e)
+		} else {
+			fmt.Fprintln(os.Stderr, e)
+			os.Exit(1)
+		}
+	}
+}
+
+// runJob runs the job once, terminating it if it runs longer than the given
+// timeout.  A timeout of zero means no timeout.  If the job is killed by a
+// signal the exit value follows the shell convention of 128 plus the signal
+// number, and if it can't be started at all the exit value is 127.
+func runJob(args []string, env []string, timeout time.Duration) (output []byte, exitvalue int, signal syscall.Signal, timedout bool, startfailed bool) {
+	if debug {
+		fmt.Printf("Spawning job\n")
+	}
+	// exec looks for the job in our PATH, but if the job has a PATH of its own
+	// that's the only place it should come from
+	jobpathenv := envValue(env, "PATH")
+	if env != nil && jobpathenv != os.Getenv("PATH") && !strings.Contains(args[0], "/") {
+		executable, ok := lookPath(args[0], jobpathenv)
+		if !ok {
+			output = []byte(fmt.Sprintf("cronwrap: unable to run job: %q not found in the job's PATH %s\n", args[0], jobpathenv))
+			return output, 127, 0, false, true
+		}
+		if debug {
+			fmt.Printf("Found %s in the job's PATH at %s\n", args[0], executable)
+		}
+		args = append([]string{executable}, args[1:]...)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	// A nil environment means the job inherits ours
+	cmd.Env = env
+	// Collect output as it is written, rather than when the job exits, so
+	// that we have whatever it wrote if it times out
+	buffer := &outputBuffer{}
+	cmd.Stdout = buffer
+	cmd.Stderr = buffer
+	// Start the job before starting the clock on the timeout, so that there is
+	// always a process to signal when the timeout expires
+	err := cmd.Start()
+	if err != nil {
+		// The job couldn't be started at all, i.e. it wasn't found.  Use the
+		// exit value a shell would for a command it can't run, rather than
+		// letting the job look like it succeeded.
+		output = append(buffer.Bytes(), fmt.Sprintf("cronwrap: unable to run job: %s\n", err)...)
+		return output, 127, 0, false, true
+	}
+
+	// Wait for the job in a goroutine
+	type CombinedOutput struct {
+		output    []byte
+		exitvalue int
+		signal    syscall.Signal
+	}
+	resch := make(chan CombinedOutput, 1)
+	go func() {
+		err := cmd.Wait()
+		output := buffer.Bytes()
+		exitvalue := 0
+		var signal syscall.Signal
+		if err != nil {
+			// This involves some Go magic I don't yet understand
+			// http://stackoverflow.com/questions/10385551/get-exit-code-go
+			if exiterr, ok := err.(*exec.ExitError); ok {
+				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+					if status.Signaled() {
+						// ExitStatus() is -1 in this case, which is useless to
+						// pass on to our caller
+						signal = status.Signal()
+						exitvalue = 128 + int(signal)
+						message := fmt.Sprintf("cronwrap: job killed by signal %s (%s)", signalName(signal), signal)
+						if status.CoreDump() {
+							message += ", core dumped"
+						}
+						output = append(output, message+"\n"...)
+					} else {
+						exitvalue = status.ExitStatus()
+					}
+				}
+			}
+		}
+		if debug {
+			fmt.Printf("Job exited with status %d\n", exitvalue)
+			fmt.Printf("Captured %d characters of output from job\n", utf8.RuneCountInString(string(output)))
+		}
+		resch <- CombinedOutput{output, exitvalue, signal}
+	}()
+	// Start another goroutine to signal a timeout
+	timech := make(chan bool, 1)
+	if timeout.Seconds() != 0 {
+		go func() {
+			time.Sleep(timeout)
+			timech <- true
+		}()
+	}
+
+	// Read from the channels, select will give us whichever one returns first
+	select {
+	case combinedOutput := <-resch:
+		output = combinedOutput.output
+		exitvalue = combinedOutput.exitvalue
+		signal = combinedOutput.signal
+	case <-timech:
+		if debug {
+			fmt.Printf("Process timed out, sending SIGTERM\n")
+		}
+		// cmd.Process.Kill() sends SIGKILL
+		// We want to try to be more graceful so we start with SIGTERM
+		needskill := true
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		for i := 0; i < 5; i++ {
+			var waitstat syscall.WaitStatus
+			waitpid, _ := syscall.Wait4(cmd.Process.Pid, &waitstat, syscall.WNOHANG, nil)
+			if waitpid != 0 {
+				needskill = false
+				break
+			}
+			time.Sleep(time.Duration(1) * time.Second)
+		}
+		if needskill {
+			if debug {
+				fmt.Printf("Process did not die, sending SIGKILL\n")
+			}
+			_ = cmd.Process.Kill()
+		}
+		if debug {
+			fmt.Printf("Process timed out, terminated\n")
+		}
+		// Give the job a moment to finish writing its output
+		select {
+		case <-resch:
+		case <-time.After(time.Second):
+		}
+		output = buffer.Bytes()
+		exitvalue = 1
+		timedout = true
+	}
+	return output, exitvalue, signal, timedout, startfailed
+}
+
+// A sane PATH for jobs started with a clean environment
+const defaultpath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// jobEnvironment returns the environment to start the job with.  That's ours,
+// or only the variables named by --keep-env if a clean environment was asked
+// for, followed by --path and the variables from --env-file and --env.  Later
+// variables override earlier ones with the same name.
+func jobEnvironment() []string {
+	var env []string
+	if cleanenv || len(keepenv) != 0 {
+		env = append(env, "PATH="+defaultpath)
+		for _, name := range keepenv {
+			value, ok := os.LookupEnv(name)
+			if ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	} else {
+		env = os.Environ()
+	}
+	if jobpath != "" {
+		env = append(env, "PATH="+jobpath)
+	}
+	return append(env, jobvars...)
+}
+
+// envValue returns the value of a variable in an environment, the last one
+// wins as with exec
+func envValue(env []string, name string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], name+"=") {
+			return env[i][len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// lookPath finds an executable in a PATH other than our own
+func lookPath(file string, pathenv string) (string, bool) {
+	for _, dir := range strings.Split(pathenv, ":") {
+		if dir == "" {
+			dir = "."
+		}
+		candidate := dir + "/" + file
+		info, err := os.Stat(candidate)
+		if err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// readEnvFile reads variables from a dotenv style file, lines of KEY=VALUE
+// optionally preceded by export.  Values in double quotes may contain \n, \"
+// and \\ escapes, values in single quotes are taken literally.  Blank lines
+// and comments are ignored.  Variables aren't expanded.
+func readEnvFile(filename string) ([]string, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var vars []string
+	for n, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i == -1 || !validenvname.MatchString(strings.TrimSpace(line[:i])) {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", filename, n+1)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		// Whatever follows a quoted value can only be a comment
+		rest := ""
+		if strings.HasPrefix(value, "'") {
+			j := strings.Index(value[1:], "'")
+			if j == -1 {
+				return nil, fmt.Errorf("%s:%d: unterminated quoted value", filename, n+1)
+			}
+			rest = value[j+2:]
+			value = value[1 : j+1]
+		} else if strings.HasPrefix(value, `"`) {
+			var unquoted strings.Builder
+			j := 1
+			for ; j < len(value) && value[j] != '"'; j++ {
+				if value[j] == '\\' && j+1 < len(value) && strings.IndexByte(`n"\`, value[j+1]) != -1 {
+					j++
+					if value[j] == 'n' {
+						unquoted.WriteByte('\n')
+					} else {
+						unquoted.WriteByte(value[j])
+					}
+				} else {
+					unquoted.WriteByte(value[j])
+				}
+			}
+			if j == len(value) {
+				return nil, fmt.Errorf("%s:%d: unterminated quoted value", filename, n+1)
+			}
+			rest = value[j+1:]
+			value = unquoted.String()
+		} else if j := strings.Index(value, " #"); j != -1 {
+			// A comment after an unquoted value
+			value = strings.TrimSpace(value[:j])
+		}
+		rest = strings.TrimSpace(rest)
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("%s:%d: unexpected text after quoted value", filename, n+1)
+		}
+		vars = append(vars, key+"="+value)
+	}
+	return vars, nil
+}
+
+// runHook runs a hook command with the shell, bounded by --hook-timeout, with
+// the given variables added to cronwrap's environment
+func runHook(command string, env []string) (output []byte, exitvalue int, timedout bool) {
+	if debug {
+		fmt.Printf("Running hook: %s\n", command)
+	}
+	output, exitvalue, _, timedout, _ = runJob([]string{"/bin/sh", "-c", command}, append(os.Environ(), env...), hooktimeout)
+	return output, exitvalue, timedout
+}
+
+// A buffer for the job's output that is safe to read while the job is still
+// writing to it
+type outputBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+// Bytes returns a copy of the output written so far
+func (b *outputBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]byte(nil), b.buffer.Bytes()...)
+}
+
+var signalnames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGSYS:  "SIGSYS",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// signalName returns the conventional name of the signal, i.e. SIGTERM
+func signalName(signal syscall.Signal) string {
+	name, ok := signalnames[signal]
+	if !ok {
+		name = fmt.Sprintf("signal %d", int(signal))
+	}
+	return name
+}
+
+// The limit on how far exponential backoff increases the retry delay
+const maxretrydelay = time.Hour
+
+// retryDelay returns how long to wait before retrying the job after the given
+// failed attempt, according to --retry-delay, --retry-backoff and
+// --retry-jitter
+func retryDelay(attempt int) time.Duration {
+	delay := retrydelay
+	if retrybackoff == "exponential" {
+		// Double the delay for each failed attempt, up to the limit.  The limit
+		// also stops the delay overflowing after enough attempts.
+		for i := 1; i < attempt && delay < maxretrydelay; i++ {
+			delay *= 2
+			if delay > maxretrydelay {
+				delay = maxretrydelay
+			}
+		}
+	}
+	if retryjitter.Seconds() != 0 {
+		// Unlike --jitter this should be different every time
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		delay += time.Duration(random.Int63n(int64(retryjitter)))
+	}
+	return delay
 }
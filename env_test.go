@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parse the output of env into a map
+func parseEnv(out []byte) map[string]string {
+	env := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		i := strings.Index(line, "=")
+		if i > 0 {
+			env[line[:i]] = line[i+1:]
+		}
+	}
+	return env
+}
+
+func TestJobEnv(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--name", "envtest", "--timeout", "1h", "env").CombinedOutput()
+	if err != nil {
+		t.Fatal(string(out))
+	}
+	env := parseEnv(out)
+	statedir := filepath.Join(home, ".cronwrap")
+	if env["CRONWRAP_JOB"] != "envtest" || env["CRONWRAP_JOB_ID"] != "envtest" || env["CRONWRAP_STATE_DIR"] != statedir ||
+		env["CRONWRAP_ATTEMPT"] != "1" || env["CRONWRAP_FAILCOUNT"] != "0" || len(env["CRONWRAP_RUN_ID"]) != 32 {
+		t.Error(env)
+	}
+	deadline, err := time.Parse(time.RFC3339, env["CRONWRAP_DEADLINE"])
+	if err != nil || deadline.Before(time.Now().Add(59*time.Minute)) || deadline.After(time.Now().Add(time.Hour)) {
+		t.Error(env["CRONWRAP_DEADLINE"])
+	}
+	records := readHistory(t, home)
+	if records[0].RunID != env["CRONWRAP_RUN_ID"] {
+		t.Error(records[0].RunID)
+	}
+
+	// Each run has its own id, and the job is told of earlier failures and
+	// which attempt this is
+	out, _ = cronwrapInHome(home, "--name", "envtest", "sh", "-c", "env; false").CombinedOutput()
+	env2 := parseEnv(out)
+	if env2["CRONWRAP_RUN_ID"] == env["CRONWRAP_RUN_ID"] || env2["CRONWRAP_DEADLINE"] != "" {
+		t.Error(env2)
+	}
+	out, _ = cronwrapInHome(home, "--name", "envtest", "--retries", "1", "--retry-delay", "0s",
+		"sh", "-c", "echo $CRONWRAP_FAILCOUNT $CRONWRAP_ATTEMPT; false").CombinedOutput()
+	if !strings.HasPrefix(string(out), "1 1\n") || !strings.Contains(string(out), "\n1 2\n") {
+		t.Error(string(out))
+	}
+}
+
+func TestCleanEnv(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--clean-env", "env").CombinedOutput()
+	if err != nil {
+		t.Fatal(string(out))
+	}
+	env := parseEnv(out)
+	if env["PATH"] != defaultpath || env["HOME"] != "" || env["CRONWRAP_JOB_ID"] == "" {
+		t.Error(env)
+	}
+	for name := range env {
+		if name != "PATH" && !strings.HasPrefix(name, "CRONWRAP_") {
+			t.Errorf("Unexpected variable %s in clean environment", name)
+		}
+	}
+
+	out, err = cronwrapInHome(home, "--keep-env", "HOME", "--keep-env", "NOSUCHVARIABLE", "env").CombinedOutput()
+	if err != nil {
+		t.Fatal(string(out))
+	}
+	env = parseEnv(out)
+	if env["HOME"] != home || env["PATH"] != defaultpath || env["GOCACHE"] != "" {
+		t.Error(env)
+	}
+	if _, ok := env["NOSUCHVARIABLE"]; ok {
+		t.Error(env)
+	}
+}
+
+func TestEnvFiles(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+	envfile := filepath.Join(home, "job.env")
+	err = ioutil.WriteFile(envfile, []byte(`# Settings for the job
+PLAIN=value
+export EXPORTED=yes
+DOUBLE="two words\nand a \"quote\""
+SINGLE='$NOT_EXPANDED \n'
+COMMENTED=value # comment
+QUOTEDCOMMENT="bar baz" # note
+SINGLECOMMENT='a # b' # note
+OVERRIDDEN=file
+
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envfile2 := filepath.Join(home, "other.env")
+	err = ioutil.WriteFile(envfile2, []byte("PLAIN=second file\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := cronwrapInHome(home, "--env-file", envfile, "--env-file", envfile2, "--env", "OVERRIDDEN=flag", "--env", "EMPTY=",
+		"sh", "-c", `printf '%s|' "$PLAIN" "$EXPORTED" "$DOUBLE" "$SINGLE" "$COMMENTED" "$QUOTEDCOMMENT" "$SINGLECOMMENT" "$OVERRIDDEN" "${EMPTY-unset}"`).CombinedOutput()
+	if err != nil {
+		t.Fatal(string(out))
+	}
+	if string(out) != "second file|yes|two words\nand a \"quote\"|$NOT_EXPANDED \\n|value|bar baz|a # b|flag||" {
+		t.Errorf("%q", out)
+	}
+
+	err = ioutil.WriteFile(envfile2, []byte("PLAIN=value\nnot a variable\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = cronwrapInHome(home, "--env-file", envfile2, "true").CombinedOutput()
+	if err == nil || !strings.HasPrefix(string(out), "Error: invalid env-file: "+envfile2+":2: expected KEY=VALUE\n") {
+		t.Error(string(out))
+	}
+	for _, line := range []string{`UNTERMINATED="value`, `TRAILING="value" text`} {
+		err = ioutil.WriteFile(envfile2, []byte(line+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = cronwrapInHome(home, "--env-file", envfile2, "true").CombinedOutput()
+		if err == nil || !strings.HasPrefix(string(out), "Error: invalid env-file: "+envfile2+":1: ") {
+			t.Error(line, string(out))
+		}
+	}
+	out, err = cronwrapInHome(home, "--env", "NOEQUALS", "true").CombinedOutput()
+	if err == nil || !strings.HasPrefix(string(out), "Error: env should be of the form KEY=VALUE\n") {
+		t.Error(string(out))
+	}
+}
+
+// The job is found in its own PATH
+func TestJobPath(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+	bin := filepath.Join(home, "bin")
+	err = os.Mkdir(bin, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(bin, "cronwrap-test-job"), []byte("#!/bin/sh\necho $PATH\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := bin + ":" + defaultpath
+	out, err := cronwrapInHome(home, "--clean-env", "--path", path, "cronwrap-test-job").CombinedOutput()
+	if err != nil || string(out) != path+"\n" {
+		t.Error(err, string(out))
+	}
+
+	// The job is only looked for in its own PATH, not in ours
+	cmd := cronwrapInHome(home, "--path", defaultpath, "cronwrap-test-job")
+	cmd.Env = append(cmd.Env, "PATH="+bin+":"+os.Getenv("PATH"))
+	out, err = cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "not found in the job's PATH") {
+		t.Error(err, string(out))
+	}
+}
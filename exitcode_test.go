@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// Ensure that the exit code options require a list of exit codes
+func TestExitCodesArgIsList(t *testing.T) {
+	for _, option := range []string{"--success-codes", "--failure-codes", "--skip-codes"} {
+		out, err := exec.Command("go", "run", "cronwrap.go", option).CombinedOutput()
+		if err == nil {
+			t.Error(string(out))
+		}
+		out, err = exec.Command("go", "run", "cronwrap.go", option, "bogus", "true").CombinedOutput()
+		if err == nil {
+			t.Error(string(out))
+		}
+		out, err = exec.Command("go", "run", "cronwrap.go", option, "5-3", "true").CombinedOutput()
+		if err == nil {
+			t.Error(string(out))
+		}
+		out, err = exec.Command("go", "run", "cronwrap.go", option, "256", "true").CombinedOutput()
+		if err == nil {
+			t.Error(string(out))
+		}
+	}
+	out, err := exec.Command("go", "run", "cronwrap.go", "--success-codes", "0,24", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--success-codes", "0,3-5", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+}
+
+// Exit codes declared to be successes should make cronwrap exit successfully
+func TestSuccessCodes(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "sh", "-c", "exit 24").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--success-codes", "0,24", "sh", "-c", "exit 24").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+}
+
+// Only exit codes declared to be failures should make cronwrap fail
+func TestFailureCodes(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--failure-codes", "2", "sh", "-c", "exit 1").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--failure-codes", "2", "sh", "-c", "exit 2").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	// A zero exit declared to be a failure still has to be reported as one
+	out, err = exec.Command("go", "run", "cronwrap.go", "--failure-codes", "0", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	// A job killed by a signal is a failure whatever its exit value maps to
+	out, err = exec.Command("go", "run", "cronwrap.go", "--failure-codes", "1", "sh", "-c", "kill -SEGV $$").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+}
+
+// Exit codes declared as skips should neither reset nor increment the failure
+// count
+func TestSkipCodes(t *testing.T) {
+	file, err := ioutil.TempFile("", "cronwrap")
+	if err != nil {
+		t.Error("file.Name()")
+	}
+
+	// The first failure is suppressed
+	file.Seek(0, os.SEEK_SET)
+	file.WriteString("fail\n")
+	file.Sync()
+	out, err := exec.Command("go", "run", "cronwrap.go", "--suppress", "2", "--skip-codes", "5", "./tester", file.Name()).CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if string(out) != "" {
+		t.Error(string(out))
+	}
+
+	// tester exits 5 when it doesn't understand its input file
+	file.Seek(0, os.SEEK_SET)
+	file.WriteString("skip\n")
+	file.Sync()
+	out, err = exec.Command("go", "run", "cronwrap.go", "--suppress", "2", "--skip-codes", "5", "./tester", file.Name()).CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if string(out) != "" {
+		t.Error(string(out))
+	}
+
+	// If the skip had reset the count this failure would be suppressed
+	file.Seek(0, os.SEEK_SET)
+	file.WriteString("fail\n")
+	file.Sync()
+	out, err = exec.Command("go", "run", "cronwrap.go", "--suppress", "2", "--skip-codes", "5", "./tester", file.Name()).CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if !strings.Contains(string(out), "tester is failing") {
+		t.Error(string(out))
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	jobdirs, _ := filepath.Glob(filepath.Join(home, ".cronwrap", "*"))
+	if len(jobdirs) != 1 {
+		t.Fatal(jobdirs)
+	}
+
+	// The job ran recently, so it should be left alone
+	out, err = cronwrapInHome(home, "gc", "--older-than", "1h").CombinedOutput()
+	if err != nil || string(out) != "" {
+		t.Error(string(out))
+	}
+
+	time.Sleep(time.Duration(2) * time.Second)
+	out, err = cronwrapInHome(home, "gc", "--older-than", "1s", "--dry-run").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), `Would remove ["true"]`) {
+		t.Error(string(out))
+	}
+	if _, err = os.Stat(jobdirs[0]); err != nil {
+		t.Error("Dry run removed job directory")
+	}
+
+	out, err = cronwrapInHome(home, "gc", "--older-than", "1s").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), `Removed ["true"]`) {
+		t.Error(string(out))
+	}
+	if _, err = os.Stat(jobdirs[0]); !os.IsNotExist(err) {
+		t.Error("Job directory was not removed")
+	}
+}
+
+// gc should never remove the state of a running job
+func TestGCRunning(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	cmd := cronwrapInHome(home, "--overlap", "sleep", "3")
+	cmd.Start()
+	time.Sleep(time.Duration(1) * time.Second) // Give the process time to start
+
+	out, err := cronwrapInHome(home, "gc", "--older-than", "0s").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "Skipping running job") {
+		t.Error(string(out))
+	}
+	jobdirs, _ := filepath.Glob(filepath.Join(home, ".cronwrap", "*"))
+	if len(jobdirs) != 1 {
+		t.Error("Job directory was removed")
+	}
+	err = cmd.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Jobs without --overlap have no PID file, but are still protected
+func TestGCRunningWithoutOverlap(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	cmd := cronwrapInHome(home, "sh", "-c", "sleep 2; echo job-output")
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Start()
+	time.Sleep(time.Duration(1) * time.Second) // Give the process time to start
+
+	out, err := cronwrapInHome(home, "gc", "--older-than", "0s", "--dry-run").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "Would skip running job") {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "gc", "--older-than", "0s").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "Skipping running job") {
+		t.Error(string(out))
+	}
+	err = cmd.Wait()
+	if err != nil || output.String() != "job-output\n" {
+		t.Error(err, output.String())
+	}
+	records := readHistory(t, home)
+	if len(records) != 1 || records[0].Result != "success" {
+		t.Error(records)
+	}
+}
+
+// A job that never completed a run has no time of last run to report
+func TestGCNeverRun(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	jobdir := filepath.Join(home, ".cronwrap", "neverrun")
+	err = os.MkdirAll(jobdir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(jobdir, "state.json"),
+		[]byte(`{"version": 1, "command": "[\"neverrun\"]", "first_seen": "2020-01-01T00:00:00Z"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := cronwrapInHome(home, "gc", "--dry-run").CombinedOutput()
+	if err != nil || string(out) != "Would remove [\"neverrun\"], last run never\n" {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "gc").CombinedOutput()
+	if err != nil || string(out) != "Removed [\"neverrun\"], last run never\n" {
+		t.Error(string(out))
+	}
+}
+
+// gc can't tell how old a job is if it can't read its state, so it should
+// leave it alone and complain
+func TestGCUnreadableState(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	states := map[string]string{
+		"corrupt": `{"version": 1, "command": "[\"corr`,
+		"newer":   `{"version": 2, "command": "[\"newer\"]", "first_seen": "2020-01-01T00:00:00Z"}`,
+	}
+	for name, state := range states {
+		jobdir := filepath.Join(home, ".cronwrap", name)
+		err = os.MkdirAll(jobdir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(jobdir, "state.json"), []byte(state), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, args := range [][]string{{"gc", "--dry-run"}, {"gc"}} {
+		out, err := cronwrapInHome(home, args...).CombinedOutput()
+		if err == nil || strings.Count(string(out), "Skipping") != 2 || strings.Contains(string(out), "emove") {
+			t.Error(args, string(out))
+		}
+	}
+	for name := range states {
+		if _, err = os.Stat(filepath.Join(home, ".cronwrap", name)); err != nil {
+			t.Error(name, "was removed")
+		}
+	}
+}
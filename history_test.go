@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readHistory returns the history records for the only job in the given
+// cronwrap home directory
+func readHistory(t *testing.T, home string) []historyRecord {
+	files, _ := filepath.Glob(filepath.Join(home, ".cronwrap", "*", "history"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one history file, found %d", len(files))
+	}
+	bytes, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []historyRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(bytes)), "\n") {
+		var record historyRecord
+		err = json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestHistory(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "sh", "-c", "echo hello").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	records := readHistory(t, home)
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, found %d", len(records))
+	}
+	record := records[0]
+	if record.Result != "success" || record.ExitStatus != 0 || record.OutputSize != 6 || record.Hostname == "" || record.Version == "" {
+		t.Error(record)
+	}
+	if record.End.Before(record.Start) {
+		t.Error(record)
+	}
+}
+
+func TestHistorySignal(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "sh", "-c", "kill -TERM $$").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	records := readHistory(t, home)
+	if records[0].Result != "failure" || records[0].Signal != "SIGTERM" || records[0].ExitStatus != 143 {
+		t.Error(records[0])
+	}
+}
+
+// A run skipped due to overlap protection has the same result in the history
+// as in the job's state
+func TestHistoryOverlap(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	cmd := cronwrapInHome(home, "--overlap", "sleep", "3")
+	cmd.Start()
+	time.Sleep(time.Duration(1) * time.Second) // Give the process time to start
+
+	out, err := cronwrapInHome(home, "--overlap", "sleep", "3").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	records := readHistory(t, home)
+	if len(records) != 1 || records[0].Result != "overlap" || !records[0].OverlapSkipped {
+		t.Error(records)
+	}
+	out, err = cronwrapInHome(home, "status", "--json").Output()
+	if err != nil || !strings.Contains(string(out), `"last_result": "overlap"`) {
+		t.Error(string(out))
+	}
+	cmd.Wait()
+}
+
+func TestHistoryRotation(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	for i := 0; i < 3; i++ {
+		out, err := cronwrapInHome(home, "--history-size", "300", "true").CombinedOutput()
+		if err != nil {
+			t.Error(string(out))
+		}
+	}
+	// Each record is well over 150 bytes, so there should only be room for one
+	// in each file
+	records := readHistory(t, home)
+	if len(records) != 1 {
+		t.Errorf("Expected 1 record, found %d", len(records))
+	}
+	files, _ := filepath.Glob(filepath.Join(home, ".cronwrap", "*", "history.1"))
+	if len(files) != 1 {
+		t.Error("History was not rotated")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreHook(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+	marker := filepath.Join(home, "ran")
+
+	out, err := cronwrapInHome(home, "--pre", "echo pre $CRONWRAP_JOB", "--name", "hooktest", "echo", "job").CombinedOutput()
+	if err != nil || string(out) != "pre hooktest\njob\n" {
+		t.Error(err, string(out))
+	}
+
+	// A failing pre hook stops the job from running and is a failure
+	out, err = cronwrapInHome(home, "--pre", "echo mount failed; exit 4", "touch", marker).CombinedOutput()
+	if err == nil || !strings.HasPrefix(string(out), "mount failed\ncronwrap: pre hook failed with exit value 4, not running job\n") {
+		t.Error(err, string(out))
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Job ran after pre hook failed")
+	}
+}
+
+// The pre hook's time doesn't count against the job's timeout
+func TestPreHookTimeout(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--pre", "sleep 2", "--timeout", "1s", "echo", "job").CombinedOutput()
+	if err != nil || string(out) != "job\n" {
+		t.Error(err, string(out))
+	}
+}
+
+// A post hook that cleans up the file of output shouldn't lose the job's
+// output or result
+func TestPostHookRemovesOutput(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--post", `rm -f "$CRONWRAP_OUTPUT"`, "--name", "hooktest",
+		"sh", "-c", "echo hello; exit 3").CombinedOutput()
+	if err == nil || !strings.HasPrefix(string(out), "hello\n") || strings.Contains(string(out), "remove") {
+		t.Error(err, string(out))
+	}
+	history, err := ioutil.ReadFile(filepath.Join(home, ".cronwrap", "hooktest", "history"))
+	if err != nil || !strings.Contains(string(history), `"result":"failure"`) {
+		t.Error(err, string(history))
+	}
+}
+
+func TestPostHook(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+	envfile := filepath.Join(home, "env")
+
+	post := "env | grep ^CRONWRAP_ | sort > " + envfile + "; cat $CRONWRAP_OUTPUT >> " + envfile
+	out, err := cronwrapInHome(home, "--post", post, "--suppress", "3", "--name", "hooktest",
+		"sh", "-c", "echo broken; exit 3").CombinedOutput()
+	if err != nil || len(out) != 0 {
+		t.Error(err, string(out))
+	}
+	env, err := ioutil.ReadFile(envfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"CRONWRAP_JOB=hooktest\n",
+		"CRONWRAP_RESULT=failure\n",
+		"CRONWRAP_EXIT_STATUS=3\n",
+		"CRONWRAP_TIMED_OUT=false\n",
+		"CRONWRAP_SUPPRESSED=true\n",
+		"CRONWRAP_OUTPUT=" + filepath.Join(home, ".cronwrap", "hooktest", "output"),
+		"\nbroken\n",
+	} {
+		if !strings.Contains(string(env), expected) {
+			t.Errorf("Expected %q in %q", expected, env)
+		}
+	}
+	if !strings.Contains(string(env), "CRONWRAP_DURATION=0.") {
+		t.Error(string(env))
+	}
+
+	// The output file is cleaned up afterwards
+	files, _ := filepath.Glob(filepath.Join(home, ".cronwrap", "hooktest", "output*"))
+	if len(files) != 0 {
+		t.Error(files)
+	}
+
+	// A failing post hook is a warning, and doesn't change the job's status
+	out, err = cronwrapInHome(home, "--post", "echo cmdb down; exit 2", "echo", "job").CombinedOutput()
+	if err != nil || string(out) != "cronwrap: post hook failed with exit value 2\ncmdb down\njob\n" {
+		t.Error(err, string(out))
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--pre", "sleep 5", "--hook-timeout", "1s", "true").CombinedOutput()
+	if err == nil || !strings.HasPrefix(string(out), "cronwrap: pre hook timed out after 1s, not running job\n") {
+		t.Error(err, string(out))
+	}
+}
+
+// on-failure is run once when failures cross the --suppress threshold, and
+// on-recovery when the job next succeeds
+func TestFailureAndRecoveryHooks(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+	hooklog := filepath.Join(home, "hooks")
+	job := filepath.Join(home, "job")
+
+	run := func(exitvalue string) {
+		err := ioutil.WriteFile(job, []byte("#!/bin/sh\necho output\nexit "+exitvalue+"\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cronwrapInHome(home, "--suppress", "2", "--name", "hooktest",
+			"--on-failure", "echo failure $CRONWRAP_FAILCOUNT $(cat $CRONWRAP_OUTPUT) >> "+hooklog,
+			"--on-recovery", "echo recovery $CRONWRAP_RESULT >> "+hooklog, job).CombinedOutput()
+		if strings.Contains(string(out), "hook") {
+			t.Error(string(out))
+		}
+	}
+	for _, exitvalue := range []string{"1", "1", "1", "0", "0", "1", "1"} {
+		run(exitvalue)
+	}
+	hooks, _ := ioutil.ReadFile(hooklog)
+	if string(hooks) != "failure 2 output\nrecovery success\nfailure 2 output\n" {
+		t.Error(string(hooks))
+	}
+}
+
+// Hook failures are reported and recorded in the history without masking the
+// job's status
+func TestHookFailure(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--on-failure", "exit 5", "--post", "sleep 5", "--hook-timeout", "1s",
+		"sh", "-c", "exit 3").CombinedOutput()
+	if err == nil || !strings.HasPrefix(string(out), "cronwrap: on-failure hook failed with exit value 5\ncronwrap: post hook timed out after 1s\nexit status 3\n") {
+		t.Error(err, string(out))
+	}
+	records := readHistory(t, home)
+	if len(records) != 1 || len(records[0].HookFailures) != 2 || records[0].HookFailures[0] != "on-failure" || records[0].HookFailures[1] != "post" {
+		t.Error(records)
+	}
+}
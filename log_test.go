@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listen on a datagram socket standing in for syslog or journald, returning
+// the socket's path
+func logListener(t *testing.T) (*net.UnixConn, string) {
+	dir, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, socket
+}
+
+// Read the messages logged by a run of cronwrap
+func readLog(conn *net.UnixConn) []string {
+	var messages []string
+	buf := make([]byte, 65536)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return messages
+		}
+		messages = append(messages, string(buf[:n]))
+	}
+}
+
+func TestLogSyslog(t *testing.T) {
+	conn, socket := logListener(t)
+	defer os.RemoveAll(filepath.Dir(socket))
+	defer conn.Close()
+
+	// The socket's directory is a fresh home so the job has no state
+	out, err := cronwrapInHome(filepath.Dir(socket), "--log", "syslog", "--log-socket", socket, "--name", "logtest",
+		"--overlap", "--suppress", "5", "sh", "-c", "echo output; exit 3").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	messages := readLog(conn)
+	events := []string{"start", "lock_acquired", "exit", "suppressed"}
+	if len(messages) != len(events) {
+		t.Fatalf("Expected %d messages, got %q", len(events), messages)
+	}
+	for i, event := range events {
+		if !strings.Contains(messages[i], " cronwrap ") || !strings.Contains(messages[i], " "+event+" [cronwrap@32473 ") ||
+			!strings.Contains(messages[i], `job="logtest"`) || !strings.Contains(messages[i], `event="`+event+`"`) ||
+			strings.Contains(messages[i], "] output") {
+			t.Errorf("Unexpected message for %s: %q", event, messages[i])
+		}
+	}
+	if !strings.HasPrefix(messages[0], "<78>1 ") || !strings.HasSuffix(messages[0], "] Starting job logtest") {
+		t.Error(messages[0])
+	}
+	if !strings.Contains(messages[2], `exit_status="3"`) {
+		t.Error(messages[2])
+	}
+	if !strings.HasPrefix(messages[3], "<77>1 ") || !strings.Contains(messages[3], `failcount="1"`) {
+		t.Error(messages[3])
+	}
+}
+
+func TestLogJournald(t *testing.T) {
+	conn, socket := logListener(t)
+	defer os.RemoveAll(filepath.Dir(socket))
+	defer conn.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--log", "journald", "--log-socket", socket,
+		"--timeout", "1s", "sleep", "5").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	messages := readLog(conn)
+	if len(messages) != 4 {
+		t.Fatalf("Expected 4 messages, got %q", messages)
+	}
+	timeout := messages[1]
+	for _, expected := range []string{
+		"MESSAGE=Job [\"sleep\" \"5\"] timed out after 1s\n",
+		"PRIORITY=4\n",
+		"SYSLOG_IDENTIFIER=cronwrap\n",
+		"CRONWRAP_EVENT=timeout\n",
+		"CRONWRAP_JOB=[\"sleep\" \"5\"]\n",
+		"CRONWRAP_ATTEMPT=1\n",
+	} {
+		if !strings.Contains(timeout, expected) {
+			t.Errorf("Expected %q in %q", expected, timeout)
+		}
+	}
+	if !strings.Contains(messages[3], "CRONWRAP_EVENT=failed\n") || !strings.Contains(messages[3], "PRIORITY=3\n") {
+		t.Error(messages[3])
+	}
+}
+
+// The job still runs if the log can't be reached
+func TestLogUnavailable(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--log", "journald", "--log-socket", "/nonexistent/socket",
+		"echo", "hello").CombinedOutput()
+	if err != nil || string(out) != "cronwrap: unable to log to journald: dial unixgram /nonexistent/socket: connect: no such file or directory\nhello\n" {
+		t.Error(err, string(out))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A minimal SMTP server that accepts a single message and sends the
+// conversation it had on the channel
+func smtpServer(t *testing.T, conversations chan string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var conversation strings.Builder
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		indata := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			conversation.WriteString(line)
+			switch {
+			case indata:
+				if line == ".\r\n" {
+					indata = false
+					conn.Write([]byte("250 OK\r\n"))
+				}
+			case strings.HasPrefix(line, "EHLO"):
+				conn.Write([]byte("250-localhost\r\n250 8BITMIME\r\n"))
+			case strings.HasPrefix(line, "DATA"):
+				indata = true
+				conn.Write([]byte("354 Go ahead\r\n"))
+			case strings.HasPrefix(line, "QUIT"):
+				conn.Write([]byte("221 Bye\r\n"))
+				conversations <- conversation.String()
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+		conversations <- conversation.String()
+	}()
+	return listener
+}
+
+func TestMailSMTP(t *testing.T) {
+	conversations := make(chan string, 1)
+	listener := smtpServer(t, conversations)
+	defer listener.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--smtp", listener.Addr().String(),
+		"--mail-to", "ops@example.com", "--mail-to", "dev@example.com", "--mail-from", "cron@example.com",
+		"--mail-subject", "{{.Job}} exited {{.ExitStatus}}", "--name", "mailtest",
+		"sh", "-c", "echo broken; exit 3").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	// The output went to the recipients rather than cron
+	if strings.Contains(string(out), "broken") {
+		t.Error(string(out))
+	}
+	conversation := <-conversations
+	for _, expected := range []string{
+		"MAIL FROM:<cron@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<dev@example.com>",
+		"Subject: mailtest exited 3\r\n",
+		"To: ops@example.com, dev@example.com\r\n",
+		"\r\n\r\nbroken\r\n",
+	} {
+		if !strings.Contains(conversation, expected) {
+			t.Errorf("Expected %q in %q", expected, conversation)
+		}
+	}
+}
+
+func TestMailSendmail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sendmail := filepath.Join(dir, "sendmail")
+	err = ioutil.WriteFile(sendmail, []byte("#!/bin/sh\necho \"$@\" > "+dir+"/args\ncat > "+dir+"/message\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--sendmail", sendmail, "--mail-to", "ops@example.com",
+		"--mail-from", "cron@example.com", "echo", "hello").CombinedOutput()
+	if err != nil || len(out) != 0 {
+		t.Error(err, string(out))
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if string(args) != "-oi -f cron@example.com -- ops@example.com\n" {
+		t.Error(string(args))
+	}
+	message, _ := ioutil.ReadFile(filepath.Join(dir, "message"))
+	if !strings.Contains(string(message), "Subject: [\"echo\" \"hello\"] success on ") || !strings.HasSuffix(string(message), "\r\n\r\nhello\r\n") {
+		t.Error(string(message))
+	}
+}
+
+// Nothing is mailed when there is no output or the failure is suppressed
+func TestMailNothingToReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sendmail := filepath.Join(dir, "sendmail")
+	err = ioutil.WriteFile(sendmail, []byte("#!/bin/sh\ncat >> "+dir+"/message\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--sendmail", sendmail, "--mail-to", "ops@example.com", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--sendmail", sendmail, "--mail-to", "ops@example.com",
+		"--suppress", "1000", "sh", "-c", "echo suppressed; false").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "message")); err == nil {
+		t.Error("Unexpected mail sent")
+	}
+}
+
+// Output is still written if the mail can't be sent
+func TestMailFailure(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--sendmail", "/nonexistent/sendmail", "--mail-to", "ops@example.com",
+		"echo", "hello").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "unable to send mail") || !strings.Contains(string(out), "hello\n") {
+		t.Error(err, string(out))
+	}
+}
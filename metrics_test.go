@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetricsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Base(dir)
+	out, err := exec.Command("go", "run", "cronwrap.go", "--name", name, "--metrics-dir", dir, "sh", "-c", "exit 3").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, name+".prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(bytes)
+	for _, expected := range []string{
+		`cronwrap_last_exit_code{cronjob="` + name + `"} 3`,
+		`cronwrap_consecutive_failures{cronjob="` + name + `"} 1`,
+		`cronwrap_last_success_timestamp_seconds{cronjob="` + name + `"} 0`,
+		`cronwrap_last_timed_out{cronjob="` + name + `"} 0`,
+		`# TYPE cronwrap_last_duration_seconds gauge`,
+		`cronwrap_last_start_timestamp_seconds{cronjob="` + name + `"} `,
+		`cronwrap_last_end_timestamp_seconds{cronjob="` + name + `"} `,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Error("Missing " + expected + " in " + metrics)
+		}
+	}
+
+	// Only the metrics file should be left in the directory
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	hidden, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(files) != 1 || len(hidden) != 0 {
+		t.Error(append(files, hidden...))
+	}
+}
+
+// Failing to write metrics shouldn't affect the job's status
+func TestMetricsDirMissing(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--metrics-dir", "/nonexistent", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if !strings.Contains(string(out), "unable to write metrics") {
+		t.Error(string(out))
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--push-url", server.URL, "--push-job", "backups", "--push-instance", "db1", "sh", "-c", "exit 2").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if strings.Contains(string(out), "unable to push metrics") {
+		t.Error(string(out))
+	}
+	request := <-requests
+	body := <-bodies
+	if request.Method != "PUT" {
+		t.Error(request.Method)
+	}
+	expected := "/metrics/job@base64/" + base64.URLEncoding.EncodeToString([]byte("backups")) + "/instance@base64/" + base64.URLEncoding.EncodeToString([]byte("db1"))
+	if request.URL.Path != expected {
+		t.Error(request.URL.Path)
+	}
+	if !strings.Contains(body, `cronwrap_last_exit_code{cronjob="[\"sh\" \"-c\" \"exit 2\"]"} 2`) {
+		t.Error(body)
+	}
+}
+
+// Failing to push metrics shouldn't affect the job's status
+func TestPushMetricsFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--push-url", server.URL, "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if !strings.Contains(string(out), "unable to push metrics") {
+		t.Error(string(out))
+	}
+
+	// Nothing listening at all
+	server.Close()
+	out, err = exec.Command("go", "run", "cronwrap.go", "--push-url", server.URL, "--push-timeout", "2s", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+}
@@ -50,3 +50,24 @@ func TestCommandRequired(t *testing.T) {
 		t.Error("Did not provide appropriate message when no command specified")
 	}
 }
+
+// Test --help-all
+func TestHelpAll(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--help-all").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	lines := strings.Split(string(out), "\n")
+	if !strings.HasPrefix(lines[0], "Usage") {
+		t.Error("Help message doesn't contain Usage")
+	}
+	// Options that aren't shown by --help should be shown by --help-all
+	if !strings.Contains(string(out), "-skip-codes") {
+		t.Error("Help message doesn't contain all options")
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "Usage") && utf8.RuneCountInString(line) > 80 {
+			t.Error(fmt.Sprintf("Help line too long: %s", line))
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ensure that names are restricted to something safe to use as a directory
+func TestNameIsSafe(t *testing.T) {
+	for _, name := range []string{"", "..", "../foo", "foo/bar", ".hidden", "foo bar"} {
+		out, err := exec.Command("go", "run", "cronwrap.go", "--name="+name, "true").CombinedOutput()
+		if name == "" {
+			if err != nil {
+				t.Error(string(out))
+			}
+		} else if err == nil {
+			t.Error(name + ": " + string(out))
+		}
+	}
+	out, err := exec.Command("go", "run", "cronwrap.go", "--name", "backup-db_1.0", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+}
+
+// A named job keeps its failure count when its command line changes
+func TestNameFailCount(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--name", "job", "--suppress", "2", "sh", "-c", "echo failing; exit 1").CombinedOutput()
+	if err != nil || string(out) != "" {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "--name", "job", "--suppress", "2", "sh", "-c", "echo still failing; exit 1").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "still failing") {
+		t.Error(string(out))
+	}
+
+	// The state should reflect the latest command line
+	state, err := readState(home + "/.cronwrap/job")
+	if err != nil || !strings.Contains(state.Command, "still failing") {
+		t.Error(state.Command)
+	}
+}
+
+// Overlap protection applies to a named job even if its command line changes
+func TestNameOverlap(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	cmd := cronwrapInHome(home, "--name", "job", "--overlap", "sleep", "3")
+	cmd.Start()
+	time.Sleep(time.Duration(1) * time.Second) // Give the process time to start
+
+	out, err := cronwrapInHome(home, "--name", "job", "--overlap", "sleep", "2").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Job is already running") {
+		t.Error(string(out))
+	}
+	cmd.Wait()
+}
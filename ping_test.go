@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A fake monitoring service that records the pings it receives
+type pingRecorder struct {
+	sync.Mutex
+	pings  []string
+	bodies []string
+	status int
+}
+
+func (p *pingRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	p.Lock()
+	defer p.Unlock()
+	p.pings = append(p.pings, r.Method+" "+r.URL.Path)
+	p.bodies = append(p.bodies, string(body))
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+	}
+}
+
+func TestPingSuppressedFailure(t *testing.T) {
+	recorder := &pingRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	// The failure is suppressed locally but monitoring should still hear of it
+	out, err := exec.Command("go", "run", "cronwrap.go", "--suppress", "1000",
+		"--ping-start", server.URL+"/uuid/start", "--ping-success", server.URL+"/uuid", "--ping-failure", server.URL+"/uuid",
+		"sh", "-c", "echo broken; exit 3").CombinedOutput()
+	if err != nil || string(out) != "" {
+		t.Error(string(out))
+	}
+	if len(recorder.pings) != 2 || recorder.pings[0] != "POST /uuid/start" || recorder.pings[1] != "POST /uuid/3" {
+		t.Error(recorder.pings)
+	}
+	if len(recorder.bodies) == 2 && recorder.bodies[1] != "broken\n" {
+		t.Error(recorder.bodies)
+	}
+}
+
+func TestPingSuccess(t *testing.T) {
+	recorder := &pingRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--ping-success", server.URL+"/uuid/", "--ping-failure", server.URL+"/uuid/", "echo", "fine").CombinedOutput()
+	if err != nil || string(out) != "fine\n" {
+		t.Error(string(out))
+	}
+	if len(recorder.pings) != 1 || recorder.pings[0] != "POST /uuid/0" || recorder.bodies[0] != "fine\n" {
+		t.Error(recorder.pings, recorder.bodies)
+	}
+}
+
+// Failed pings are retried, and don't affect the job's status
+func TestPingRetry(t *testing.T) {
+	recorder := &pingRecorder{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--ping-success", server.URL+"/uuid", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if !strings.Contains(string(out), "unable to send success ping") {
+		t.Error(string(out))
+	}
+	if len(recorder.pings) != 3 {
+		t.Error(recorder.pings)
+	}
+}
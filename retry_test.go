@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ensure that --retries requires a non-negative integer
+func TestRetriesArgIsInt(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--retries").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--retries", "bogus", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--retries", "-1", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--retries", "2", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+}
+
+// Ensure that --retry-backoff only accepts known backoff methods
+func TestRetryBackoffArg(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--retry-backoff", "bogus", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--retry-backoff", "exponential", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+}
+
+// A job that fails and then succeeds on retry should be a success, and the
+// output from both attempts should be reported
+func TestRetrySuccess(t *testing.T) {
+	file, err := ioutil.TempFile("", "cronwrap")
+	if err != nil {
+		t.Error("tempfile")
+	}
+	defer os.Remove(file.Name())
+
+	script := "echo attempt >> " + file.Name() + "; cat " + file.Name() + "; [ `wc -l < " + file.Name() + "` -ge 2 ]"
+	out, err := exec.Command("go", "run", "cronwrap.go", "--retries", "2", "--retry-delay", "1s", "sh", "-c", script).CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if strings.Count(string(out), "attempt\n") != 3 {
+		t.Error(string(out))
+	}
+	if !strings.Contains(string(out), "attempt 1 of 3 failed") {
+		t.Error(string(out))
+	}
+}
+
+// A job that fails every attempt should be a failure, but only counts as one
+// failure for suppression
+func TestRetryFailure(t *testing.T) {
+	file, err := ioutil.TempFile("", "cronwrap")
+	if err != nil {
+		t.Error("tempfile")
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("fail\n")
+	file.Sync()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--retries", "2", "--retry-delay", "0", "./tester", file.Name()).CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if strings.Count(string(out), "tester is failing") != 3 {
+		t.Error(string(out))
+	}
+
+	// Use a different command line so that we start with a fresh failure count
+	out, err = exec.Command("go", "run", "cronwrap.go", "--retries", "1", "--retry-delay", "0", "--suppress", "2", "./tester", file.Name(), "extra").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if string(out) != "" {
+		t.Error(string(out))
+	}
+}
+
+// Exponential backoff is limited, and doesn't overflow after many attempts
+func TestRetryDelayLimit(t *testing.T) {
+	retrydelay = 10 * time.Second
+	retrybackoff = "exponential"
+	defer func() { retrybackoff = "fixed" }()
+	if delay := retryDelay(3); delay != 40*time.Second {
+		t.Error(delay)
+	}
+	for _, attempt := range []int{10, 30, 31, 32, 64, 1000} {
+		if delay := retryDelay(attempt); delay != maxretrydelay {
+			t.Errorf("Attempt %d delay %s", attempt, delay)
+		}
+	}
+}
+
+// Output written before an attempt timed out is kept, and the timeouts are
+// reported
+func TestRetryTimeoutOutput(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--retries", "1", "--retry-delay", "0s", "--timeout", "1s",
+		"--timeout-per-attempt", "sh", "-c", "echo slow; sleep 5").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	expected := "slow\ncronwrap: attempt 1 of 2 timed out after 1s, retrying in 0s\nslow\ncronwrap: job timed out after 1s\n"
+	if !strings.HasPrefix(string(out), expected) {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// A job killed by a signal should be reported as such, with the conventional
+// 128+signal exit value
+func TestSignal(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "sh", "-c", "kill -TERM $$").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if !strings.Contains(string(out), "killed by signal SIGTERM") {
+		t.Error(string(out))
+	}
+	// go run reports the exit value of the program it ran
+	if !strings.Contains(string(out), "exit status 143") {
+		t.Error(string(out))
+	}
+}
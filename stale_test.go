@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cronwrapInHome returns a command that runs cronwrap with HOME set to the
+// given directory, so that tests can work with cronwrap's state in isolation.
+// GOCACHE is set explicitly so that go run can still use the build cache.
+func cronwrapInHome(home string, args ...string) *exec.Cmd {
+	gocache, _ := exec.Command("go", "env", "GOCACHE").Output()
+	cmd := exec.Command("go", append([]string{"run", "cronwrap.go"}, args...)...)
+	cmd.Env = append(os.Environ(), "HOME="+home, "GOCACHE="+strings.TrimSpace(string(gocache)), "XDG_STATE_HOME=", "CRONWRAP_STATE_DIR=")
+	return cmd
+}
+
+func TestCheckStale(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	// No jobs, nothing is stale
+	out, err := cronwrapInHome(home, "check-stale").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+
+	out, err = cronwrapInHome(home, "--max-age", "2s", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "--max-age", "1h", "false").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "check-stale").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+
+	// Once the successful job's last success is too old it should be reported,
+	// but the failing job is still within its maximum age
+	time.Sleep(time.Duration(3) * time.Second)
+	out, err = cronwrapInHome(home, "check-stale").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if !strings.Contains(string(out), `["true"]`) || strings.Contains(string(out), `["false"]`) {
+		t.Error(string(out))
+	}
+
+	// A default maximum age applies to jobs that didn't declare one
+	out, err = cronwrapInHome(home, "sh", "-c", "exit 1").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "check-stale", "--max-age", "1h").CombinedOutput()
+	if strings.Contains(string(out), `"sh"`) {
+		t.Error(string(out))
+	}
+}
+
+// A job that can't be started is a failure, it mustn't count as a success
+func TestCheckStaleJobNotFound(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--max-age", "1s", "no-such-cronwrap-command").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "unable to run job") {
+		t.Error(string(out))
+	}
+
+	time.Sleep(time.Duration(2) * time.Second)
+	out, err = cronwrapInHome(home, "check-stale").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "has never succeeded") {
+		t.Error(string(out))
+	}
+}
+
+// A job with a bad maximum age in its state is reported without stopping
+// check-stale from looking at the other jobs
+func TestCheckStaleInvalidMaxAge(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--name", "a", "--max-age", "1h", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "--name", "b", "--max-age", "1s", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	statefile := filepath.Join(home, ".cronwrap", "a", "state.json")
+	bytes, _ := ioutil.ReadFile(statefile)
+	ioutil.WriteFile(statefile, []byte(strings.Replace(string(bytes), `"1h0m0s"`, `"bogus"`, 1)), 0644)
+
+	time.Sleep(time.Duration(2) * time.Second)
+	out, err = cronwrapInHome(home, "check-stale").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Invalid maximum age") || !strings.Contains(string(out), `["true"]: last succeeded`) {
+		t.Error(string(out))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Copies of a job that finish at the same time shouldn't lose updates to the
+// failure count
+func TestConcurrentFailCount(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	copies := 10
+	var wg sync.WaitGroup
+	for i := 0; i < copies; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = cronwrapInHome(home, "false").Run()
+		}()
+	}
+	wg.Wait()
+
+	jobdirs, _ := filepath.Glob(filepath.Join(home, ".cronwrap", "*"))
+	if len(jobdirs) != 1 {
+		t.Fatalf("Expected one job directory, found %d", len(jobdirs))
+	}
+	state, err := readState(jobdirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.FailCount != copies {
+		t.Errorf("Expected failure count %d, was %d", copies, state.FailCount)
+	}
+
+	// Temporary files used to write state should not be left behind
+	files, _ := filepath.Glob(filepath.Join(jobdirs[0], ".*"))
+	if len(files) != 0 {
+		t.Error(files)
+	}
+}
+
+// State kept in separate files by older versions of cronwrap should be
+// migrated to the state file
+func TestStateMigration(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	// Run the job once so we know where its directory is, then replace its state
+	// with the old layout
+	out, err := cronwrapInHome(home, "false").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	jobdirs, _ := filepath.Glob(filepath.Join(home, ".cronwrap", "*"))
+	if len(jobdirs) != 1 {
+		t.Fatalf("Expected one job directory, found %d", len(jobdirs))
+	}
+	jobdir := jobdirs[0]
+	os.Remove(filepath.Join(jobdir, "state.json"))
+	ioutil.WriteFile(filepath.Join(jobdir, "command"), []byte(`["false"]`), 0644)
+	ioutil.WriteFile(filepath.Join(jobdir, "failcount"), []byte("4"), 0644)
+	firstfail := time.Now().Add(-time.Hour).Unix()
+	ioutil.WriteFile(filepath.Join(jobdir, "firstfail"), []byte(strconv.FormatInt(firstfail, 10)), 0644)
+
+	out, err = cronwrapInHome(home, "false").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	state, err := readState(jobdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != stateversion || state.Command != `["false"]` || state.FailCount != 5 {
+		t.Error(state)
+	}
+	if state.FirstFailure == nil || state.FirstFailure.Unix() != firstfail {
+		t.Error(state)
+	}
+	for _, filename := range legacystatefiles {
+		if _, err = os.Stat(filepath.Join(jobdir, filename)); !os.IsNotExist(err) {
+			t.Error(filename + " was not removed")
+		}
+	}
+}
+
+// cronwrap should still run the job with state from a newer version of itself,
+// but leave that state alone rather than mangle it
+func TestStateVersion(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--name", "newer", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	statefile := filepath.Join(home, ".cronwrap", "newer", "state.json")
+	ioutil.WriteFile(statefile, []byte(`{"version": 1000}`), 0644)
+	out, err = cronwrapInHome(home, "--name", "newer", "echo", "ran").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "newer version") || !strings.HasSuffix(string(out), "ran\n") {
+		t.Error(string(out))
+	}
+	bytes, _ := ioutil.ReadFile(statefile)
+	if string(bytes) != `{"version": 1000}` {
+		t.Error(string(bytes))
+	}
+}
+
+// A corrupt state file shouldn't stop the job running, and is replaced with
+// fresh state
+func TestStateCorrupt(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "--name", "corrupt", "false").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	statefile := filepath.Join(home, ".cronwrap", "corrupt", "state.json")
+	ioutil.WriteFile(statefile, []byte("{"), 0644)
+	out, err = cronwrapInHome(home, "--name", "corrupt", "echo", "ran").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "Invalid state file") || !strings.HasSuffix(string(out), "ran\n") {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "status", "--json").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), `"last_result": "success"`) {
+		t.Error(string(out))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// jobDirs returns the job directories within the given state directory
+func jobDirs(statedir string) []string {
+	dirs, _ := filepath.Glob(filepath.Join(statedir, "*", "state.json"))
+	return dirs
+}
+
+func TestStateDir(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	statedir := filepath.Join(home, "flag")
+	out, err := cronwrapInHome(home, "--state-dir", statedir, "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if len(jobDirs(statedir)) != 1 {
+		t.Error("Job state not in --state-dir")
+	}
+
+	statedir = filepath.Join(home, "env")
+	cmd := cronwrapInHome(home, "true")
+	cmd.Env = append(cmd.Env, "CRONWRAP_STATE_DIR="+statedir)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if len(jobDirs(statedir)) != 1 {
+		t.Error("Job state not in CRONWRAP_STATE_DIR")
+	}
+
+	// An explicit state directory takes precedence over --system, without
+	// setting up the system directory
+	_, systemerr := os.Stat(systemdir)
+	statedir = filepath.Join(home, "system")
+	out, err = cronwrapInHome(home, "--system", "--state-dir", statedir, "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if len(jobDirs(statedir)) != 1 {
+		t.Error("Job state not in --state-dir with --system")
+	}
+	if _, err = os.Stat(systemdir); os.IsNotExist(systemerr) && !os.IsNotExist(err) {
+		t.Error("System state directory created")
+	}
+
+	// The subcommands should use the same state directory
+	out, err = cronwrapInHome(home, "status", "--state-dir", statedir).CombinedOutput()
+	if err != nil || len(out) == 0 {
+		t.Error(string(out))
+	}
+
+	// No state should have ended up in the default location
+	if _, err = os.Stat(filepath.Join(home, ".cronwrap")); !os.IsNotExist(err) {
+		t.Error("Job state in HOME")
+	}
+}
+
+func TestStateDirXDG(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	cmd := cronwrapInHome(home, "true")
+	cmd.Env = append(cmd.Env, "XDG_STATE_HOME="+filepath.Join(home, "xdg"))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if len(jobDirs(filepath.Join(home, "xdg", "cronwrap"))) != 1 {
+		t.Error("Job state not in XDG_STATE_HOME")
+	}
+
+	// Without HOME or XDG_STATE_HOME cronwrap has nowhere to keep state
+	cmd = cronwrapInHome(home, "true")
+	cmd.Env = append(cmd.Env, "HOME=")
+	out, err = cmd.CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+}
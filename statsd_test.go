@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStatsd returns the metrics in the next packet received by the fake
+// StatsD agent, sorted for easy comparison
+func readStatsd(t *testing.T, conn net.PacketConn) []string {
+	buffer := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Duration(30) * time.Second))
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := strings.Split(string(buffer[:n]), "\n")
+	sort.Strings(metrics)
+	return metrics
+}
+
+func TestStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--statsd", conn.LocalAddr().String(), "--statsd-prefix", "test.", "--timeout", "1s", "sleep", "5").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	metrics := readStatsd(t, conn)
+	if len(metrics) != 4 || !strings.HasPrefix(metrics[0], "test.duration:") || !strings.HasSuffix(metrics[0], "|ms") ||
+		metrics[1] != "test.failures:1|c" || metrics[2] != "test.runs:1|c" || metrics[3] != "test.timeouts:1|c" {
+		t.Error(metrics)
+	}
+}
+
+func TestDogStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--statsd", conn.LocalAddr().String(), "--statsd-format", "dogstatsd", "--statsd-tags", "env:test", "--name", "dogjob", "--suppress", "1000", "false").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	metrics := readStatsd(t, conn)
+	if len(metrics) != 4 || metrics[1] != "cronwrap.failures:1|c|#job:dogjob,env:test" || metrics[2] != "cronwrap.runs:1|c|#job:dogjob,env:test" ||
+		metrics[3] != "cronwrap.suppressed_failures:1|c|#job:dogjob,env:test" {
+		t.Error(metrics)
+	}
+}
+
+// Sending metrics is fire and forget, nothing listening shouldn't matter
+func TestStatsdNotListening(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--statsd", "127.0.0.1:1", "true").CombinedOutput()
+	if err != nil || string(out) != "" {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--statsd-format", "bogus", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+}
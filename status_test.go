@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	out, err := cronwrapInHome(home, "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "false").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+
+	out, err = cronwrapInHome(home, "status").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "LAST RUN") {
+		t.Error(string(out))
+	}
+	for _, line := range lines[1:] {
+		if strings.Contains(line, `["true"]`) && !strings.Contains(line, "success") {
+			t.Error(line)
+		}
+		if strings.Contains(line, `["false"]`) && !strings.Contains(line, "failure") {
+			t.Error(line)
+		}
+	}
+}
+
+// Named jobs that share a command line are told apart by their names
+func TestStatusNamed(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	for _, name := range []string{"j2", "j3"} {
+		out, err := cronwrapInHome(home, "--name", name, "true").CombinedOutput()
+		if err != nil {
+			t.Error(string(out))
+		}
+	}
+
+	out, err := cronwrapInHome(home, "status").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), " JOB ") {
+		t.Error(string(out))
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], " j2 ") || !strings.Contains(lines[2], " j3 ") {
+		t.Error(string(out))
+	}
+
+	out, err = cronwrapInHome(home, "status", "--json").Output()
+	if err != nil {
+		t.Error(string(out))
+	}
+	var statuses []jobStatus
+	err = json.Unmarshal(out, &statuses)
+	if err != nil || len(statuses) != 2 || statuses[0].Job != "j2" || statuses[1].Job != "j3" {
+		t.Error(string(out))
+	}
+}
+
+// The subcommands can follow the options for the state directory, but not
+// other options, which would make them a job of the same name
+func TestStatusAfterOptions(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+	statedir := filepath.Join(home, "state")
+
+	out, err := cronwrapInHome(home, "--state-dir", statedir, "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "--state-dir", statedir, "status", "--json").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), `"command": "[\"true\"]"`) {
+		t.Error(string(out))
+	}
+	out, err = cronwrapInHome(home, "--state-dir="+statedir, "gc", "--dry-run").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+
+	out, err = cronwrapInHome(home, "--state-dir", statedir, "--debug", "status").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "use -- to run a job named status") {
+		t.Error(string(out))
+	}
+	if len(jobDirs(statedir)) != 1 {
+		t.Error("Subcommand run as a job")
+	}
+}
+
+// Copies of status running at the same time shouldn't mistake each other's
+// checks of the run lock for a running job
+func TestStatusConcurrent(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		out, err := cronwrapInHome(home, "--name", name, "true").CombinedOutput()
+		if err != nil {
+			t.Error(string(out))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := cronwrapInHome(home, "status", "--json").Output()
+			if err != nil || strings.Contains(string(out), `"running": true`) {
+				t.Error(string(out))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStatusJSON(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	// Start a job and check the status while it is running
+	cmd := cronwrapInHome(home, "--overlap", "sleep", "3")
+	cmd.Start()
+	time.Sleep(time.Duration(1) * time.Second) // Give the process time to start
+
+	out, err := cronwrapInHome(home, "status", "--json").Output()
+	if err != nil {
+		t.Error(string(out))
+	}
+	var statuses []jobStatus
+	err = json.Unmarshal(out, &statuses)
+	if err != nil {
+		t.Fatal(string(out))
+	}
+	if len(statuses) != 1 || statuses[0].Command != `["sleep" "3"]` || !statuses[0].Running || statuses[0].PID == 0 {
+		t.Error(string(out))
+	}
+
+	cmd.Wait()
+	out, err = cronwrapInHome(home, "status", "--json").Output()
+	if err != nil {
+		t.Error(string(out))
+	}
+	statuses = nil
+	err = json.Unmarshal(out, &statuses)
+	if err != nil {
+		t.Fatal(string(out))
+	}
+	if len(statuses) != 1 || statuses[0].Running || statuses[0].LastResult != "success" || statuses[0].LastRun == nil {
+		t.Error(string(out))
+	}
+}
+
+// Whether a job is running is worked out from its run lock, which every run
+// holds, while the PID file only supplies the PID of --overlap jobs
+func TestStatusRunning(t *testing.T) {
+	home, err := ioutil.TempDir("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(home)
+
+	readStatus := func() jobStatus {
+		out, err := cronwrapInHome(home, "status", "--json").Output()
+		if err != nil {
+			t.Error(string(out))
+		}
+		var statuses []jobStatus
+		err = json.Unmarshal(out, &statuses)
+		if err != nil || len(statuses) != 1 {
+			t.Fatal(string(out))
+		}
+		return statuses[0]
+	}
+
+	// Jobs without --overlap are running but have no PID
+	cmd := cronwrapInHome(home, "--name", "statustest", "sleep", "3")
+	cmd.Start()
+	time.Sleep(time.Duration(1) * time.Second) // Give the process time to start
+	status := readStatus()
+	if !status.Running || status.PID != 0 {
+		t.Error(status)
+	}
+	cmd.Wait()
+
+	// A PID file of a live process doesn't make a job running on its own
+	pidfile := filepath.Join(home, ".cronwrap", "statustest", "pid")
+	err = ioutil.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = readStatus()
+	if status.Running || status.PID != 0 {
+		t.Error(status)
+	}
+
+	// Nor is the PID of a dead process reported for a running job
+	err = ioutil.WriteFile(pidfile, []byte(strconv.Itoa(0x3fffffff)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = cronwrapInHome(home, "--name", "statustest", "sleep", "3")
+	cmd.Start()
+	time.Sleep(time.Duration(1) * time.Second) // Give the process time to start
+	status = readStatus()
+	if !status.Running || status.PID != 0 {
+		t.Error(status)
+	}
+	cmd.Wait()
+
+	// An --overlap run replaces a stale PID file, even one with a longer PID
+	// than its own
+	err = ioutil.WriteFile(pidfile, []byte("999999999"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = cronwrapInHome(home, "--name", "statustest", "--overlap", "sleep", "3")
+	cmd.Start()
+	time.Sleep(time.Duration(1) * time.Second) // Give the process time to start
+	status = readStatus()
+	if !status.Running || status.PID == 0 {
+		t.Error(status)
+	}
+	cmd.Wait()
+}
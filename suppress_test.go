@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Ensure that --suppress requires an argument
@@ -188,3 +189,127 @@ func TestSuppress(t *testing.T) {
 		t.Error(string(out))
 	}
 }
+
+// Ensure that --suppress-for requires an argument
+func TestSuppressForRequiresArg(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--suppress-for").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+}
+
+// Ensure that the argument must be a non-negative time delta
+func TestSuppressForArgIsDelta(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--suppress-for", "bogus", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--suppress-for", "-1s", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--suppress-for", "0", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--suppress-for", "1h", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+}
+
+func TestSuppressFor(t *testing.T) {
+	file, err := ioutil.TempFile("", "cronwrap")
+	if err != nil {
+		t.Error("file.Name()")
+	}
+
+	// Failures are suppressed until the job has been failing long enough
+	file.Seek(0, os.SEEK_SET)
+	file.WriteString("fail\n")
+	file.Sync()
+	out, err := exec.Command("go", "run", "cronwrap.go", "--suppress-for", "3s", "./tester", file.Name()).CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if string(out) != "" {
+		t.Error(string(out))
+	}
+	time.Sleep(time.Duration(4) * time.Second)
+	out, err = exec.Command("go", "run", "cronwrap.go", "--suppress-for", "3s", "./tester", file.Name()).CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if !strings.Contains(string(out), "tester is failing") {
+		t.Error(string(out))
+	}
+
+	// A success resets the clock
+	file.Seek(0, os.SEEK_SET)
+	file.WriteString("succeed\n")
+	file.Sync()
+	out, err = exec.Command("go", "run", "cronwrap.go", "--suppress-for", "3s", "./tester", file.Name()).CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if string(out) != "" {
+		t.Error(string(out))
+	}
+	file.Seek(0, os.SEEK_SET)
+	file.WriteString("fail\n")
+	file.Sync()
+	out, err = exec.Command("go", "run", "cronwrap.go", "--suppress-for", "3s", "./tester", file.Name()).CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if string(out) != "" {
+		t.Error(string(out))
+	}
+}
+
+// Ensure that --flap-window and --flap-threshold validate their arguments
+func TestFlapArgs(t *testing.T) {
+	out, err := exec.Command("go", "run", "cronwrap.go", "--flap-window", "-1", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--flap-threshold", "1.5", "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--flap-window", "5", "--flap-threshold", "0.2", "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+}
+
+// A job alternating between success and failure never reaches the suppress
+// threshold, but should be reported once enough of the window has failed
+func TestFlapping(t *testing.T) {
+	file, err := ioutil.TempFile("", "cronwrap")
+	if err != nil {
+		t.Error("file.Name()")
+	}
+
+	for i, trigger := range []string{"succeed\n", "fail\n", "succeed\n", "fail\n"} {
+		file.Seek(0, os.SEEK_SET)
+		file.WriteString(trigger)
+		file.Sync()
+		out, err := exec.Command("go", "run", "cronwrap.go", "--suppress", "3", "--flap-window", "4", "--flap-threshold", "0.4", "./tester", file.Name()).CombinedOutput()
+		if i < 3 {
+			if err != nil {
+				t.Error(string(out))
+			}
+			if string(out) != "" {
+				t.Error(string(out))
+			}
+		} else {
+			if err == nil {
+				t.Error(string(out))
+			}
+			if !strings.Contains(string(out), "tester is failing") || !strings.Contains(string(out), "failed 2 of the last 4 runs") {
+				t.Error(string(out))
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// The spans in an OTLP JSON request
+func readSpans(t *testing.T, body []byte) map[string]otlpSpan {
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := map[string]otlpSpan{}
+	for _, span := range payload.ResourceSpans[0].ScopeSpans[0].Spans {
+		spans[strings.Fields(span.Name)[0]] = span
+	}
+	return spans
+}
+
+func TestTrace(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := webhookServer(requests, bodies)
+	defer server.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--otlp-endpoint", server.URL+"/v1/traces", "--name", "tracetest",
+		"--jitter", "1s", "--overlap", "sh", "-c", "echo $TRACEPARENT; exit 3").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(requests))
+	}
+	request := <-requests
+	if request.URL.Path != "/v1/traces" || request.Header.Get("Content-Type") != "application/json" {
+		t.Error(request.URL, request.Header)
+	}
+	spans := readSpans(t, <-bodies)
+	if len(spans) != 4 {
+		t.Fatal(spans)
+	}
+	root := spans["cronwrap"]
+	if root.Name != "cronwrap tracetest" || root.ParentSpanID != "" || len(root.TraceID) != 32 || root.Status == nil || root.Status.Code != 2 {
+		t.Error(root)
+	}
+	for _, name := range []string{"jitter", "lock", "job"} {
+		if spans[name].TraceID != root.TraceID || spans[name].ParentSpanID != root.SpanID {
+			t.Error(spans[name])
+		}
+	}
+	job := spans["job"]
+	if job.Attributes[0].Key != "process.exit.code" || job.Attributes[0].Value["intValue"] != "3" {
+		t.Error(job.Attributes)
+	}
+
+	// The job is given its span's context
+	if !strings.HasPrefix(string(out), "00-"+root.TraceID+"-"+job.SpanID+"-01\n") {
+		t.Error(string(out))
+	}
+}
+
+// A run started with trace context is part of that trace
+func TestTraceParent(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := webhookServer(requests, bodies)
+	defer server.Close()
+
+	cmd := exec.Command("go", "run", "cronwrap.go", "--otlp-endpoint", server.URL, "true")
+	cmd.Env = append(os.Environ(), "TRACEPARENT=00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	spans := readSpans(t, <-bodies)
+	root := spans["cronwrap"]
+	if root.TraceID != "0af7651916cd43dd8448eb211c80319c" || root.ParentSpanID != "b7ad6b7169203331" || root.Status != nil {
+		t.Error(root)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// A fake webhook receiver that records the requests it receives
+func webhookServer(requests chan *http.Request, bodies chan []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+}
+
+func TestWebhook(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := webhookServer(requests, bodies)
+	defer server.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--webhook", server.URL, "--webhook-header", "Authorization: Bearer secret",
+		"sh", "-c", "echo broken; exit 3").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 webhook request, got %d", len(requests))
+	}
+	request := <-requests
+	if request.Header.Get("Authorization") != "Bearer secret" || request.Header.Get("Content-Type") != "application/json" {
+		t.Error(request.Header)
+	}
+	var report runReport
+	err = json.Unmarshal(<-bodies, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Job != `["sh" "-c" "echo broken; exit 3"]` || report.ExitStatus != 3 || report.Output != "broken\n" || report.Host == "" || report.FailCount == 0 {
+		t.Error(report)
+	}
+}
+
+// Suppressed failures and successes aren't reported
+func TestWebhookSuppressed(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := webhookServer(requests, bodies)
+	defer server.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--webhook", server.URL, "--suppress", "1000", "false").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	out, err = exec.Command("go", "run", "cronwrap.go", "--webhook", server.URL, "true").CombinedOutput()
+	if err != nil {
+		t.Error(string(out))
+	}
+	if len(requests) != 0 {
+		t.Errorf("Expected no webhook requests, got %d", len(requests))
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := webhookServer(requests, bodies)
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempfile")
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"text": {{json (printf "%s exited %d: %s" .Job .ExitStatus .Output)}}}`)
+	file.Close()
+
+	out, err := exec.Command("go", "run", "cronwrap.go", "--name", "slacky", "--webhook", server.URL, "--webhook-template", file.Name(),
+		"sh", "-c", `echo '"quoted"'; exit 4`).CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("Expected 1 webhook request, got %d", len(bodies))
+	}
+	var payload map[string]string
+	body := <-bodies
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		t.Fatal(string(body))
+	}
+	if payload["text"] != "slacky exited 4: \"quoted\"\n" {
+		t.Error(payload)
+	}
+
+	// An invalid template should be caught before running the job
+	file, err = ioutil.TempFile("", "cronwrap")
+	if err != nil {
+		t.Fatal("tempfile")
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{{bogus`)
+	file.Close()
+	out, err = exec.Command("go", "run", "cronwrap.go", "--webhook", server.URL, "--webhook-template", file.Name(), "true").CombinedOutput()
+	if err == nil {
+		t.Error(string(out))
+	}
+}